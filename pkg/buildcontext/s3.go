@@ -0,0 +1,93 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package buildcontext fetches a build context tarball from whatever
+// remote kaniko was pointed at. S3Context is the S3 source: `s3://` (or
+// the bare "bucket/key" kaniko accepts for the other remote sources).
+package buildcontext
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// GetObjectAPI is the subset of *s3.Client the S3 build context source
+// needs.
+type GetObjectAPI interface {
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3Options carries the cross-account knobs set by --s3-request-payer and
+// --s3-expected-bucket-owner. It's applied to every GetObject the context
+// fetch issues - the build-context-fetch counterpart of
+// pkg/executor/push/s3dest's Destination on the push side, so a
+// requester-pays or cross-account bucket works the same way on both ends
+// of a build.
+type S3Options struct {
+	RequestPayer        types.RequestPayer
+	ExpectedBucketOwner *string
+}
+
+// S3Context fetches and unpacks a build context tarball stored at
+// s3://<Bucket>/<Key>.
+type S3Context struct {
+	Bucket  string
+	Key     string
+	Client  GetObjectAPI
+	Options S3Options
+}
+
+// NewS3Context parses a "bucket/key"-form context string (kaniko strips
+// the "s3://" scheme before this point, matching its other remote
+// context sources) and returns the S3Context that fetches it.
+func NewS3Context(contextPath string, client GetObjectAPI, opts S3Options) (*S3Context, error) {
+	bucket, key, found := strings.Cut(contextPath, "/")
+	if !found || bucket == "" || key == "" {
+		return nil, errors.Errorf("buildcontext: S3 context %q must be \"bucket/key\"", contextPath)
+	}
+	return &S3Context{Bucket: bucket, Key: key, Client: client, Options: opts}, nil
+}
+
+// UnpackTarFromBuildContext downloads the context tarball and extracts it
+// into directory, returning directory on success to match kaniko's other
+// BuildContext sources.
+func (s *S3Context) UnpackTarFromBuildContext(directory string) (string, error) {
+	out, err := s.Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket:              &s.Bucket,
+		Key:                 &s.Key,
+		RequestPayer:        s.Options.RequestPayer,
+		ExpectedBucketOwner: s.Options.ExpectedBucketOwner,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "fetching S3 build context")
+	}
+	defer out.Body.Close()
+
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return "", errors.Wrap(err, "creating build context directory")
+	}
+	if _, err := util.UnTar(out.Body, directory); err != nil {
+		return "", errors.Wrap(err, "extracting S3 build context")
+	}
+	return directory, nil
+}
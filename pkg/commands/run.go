@@ -17,19 +17,27 @@ limitations under the License.
 package commands
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/constants"
+	"github.com/GoogleContainerTools/kaniko/pkg/contenthash"
+	"github.com/GoogleContainerTools/kaniko/pkg/copier"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	cachemount "github.com/GoogleContainerTools/kaniko/pkg/mount/cache"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
@@ -44,17 +52,21 @@ type RunOutput struct {
 
 type RunCommand struct {
 	BaseCommand
-	cmd          *instructions.RunCommand
-	output       *RunOutput
-	buildSecrets []string
-	shdCache     bool
+	cmd           *instructions.RunCommand
+	output        *RunOutput
+	buildSecrets  []string
+	sshSources    []string
+	shdCache      bool
+	excludedPaths []string
 }
 
 const secretsDir = "/run/secrets"
 
 // for testing
 var (
-	userLookup = util.LookupUser
+	userLookup     = rootfsLookupUser
+	cacheMountRoot = filepath.Join(kConfig.CacheDir, "mounts")
+	sharedCacheMgr = cachemount.NewManager(cacheMountRoot)
 )
 
 func (r *RunCommand) IsArgsEnvsRequiredInCache() bool {
@@ -62,10 +74,12 @@ func (r *RunCommand) IsArgsEnvsRequiredInCache() bool {
 }
 
 func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	return runCommandInExec(config, buildArgs, r.cmd, r.output, r.buildSecrets)
+	excluded, err := runCommandInExec(config, buildArgs, r.cmd, r.output, r.buildSecrets, r.sshSources)
+	r.excludedPaths = excluded
+	return err
 }
 
-func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand, output *RunOutput, buildSecrets []string) (err error) {
+func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand, output *RunOutput, buildSecrets, sshSources []string) (excludedPaths []string, err error) {
 	if output == nil {
 		output = &RunOutput{}
 	}
@@ -120,20 +134,20 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	userAndGroup := strings.Split(u, ":")
 	userStr, err := util.ResolveEnvironmentReplacement(userAndGroup[0], replacementEnvs, false)
 	if err != nil {
-		return errors.Wrapf(err, "resolving user %s", userAndGroup[0])
+		return nil, errors.Wrapf(err, "resolving user %s", userAndGroup[0])
 	}
 
 	// If specified, run the command as a specific user
 	if userStr != "" {
 		cmd.SysProcAttr.Credential, err = util.SyscallCredentials(userStr)
 		if err != nil {
-			return errors.Wrap(err, "credentials")
+			return nil, errors.Wrap(err, "credentials")
 		}
 	}
 
 	env, err := addDefaultHOME(userStr, replacementEnvs)
 	if err != nil {
-		return errors.Wrap(err, "adding default HOME variable")
+		return nil, errors.Wrap(err, "adding default HOME variable")
 	}
 
 	cmdRun.Expand(func(word string) (string, error) {
@@ -148,11 +162,16 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	for _, s := range buildSecrets {
 		secretName, secretValue, found := strings.Cut(s, "=")
 		if !found {
-			return fmt.Errorf("invalid secret %s", s)
+			return nil, fmt.Errorf("invalid secret %s", s)
 		}
 		buildSecretsMap[secretName] = secretValue
 	}
 
+	sshSourcesMap, err := parseSSHSources(sshSources)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing --ssh flags")
+	}
+
 	secretFileManager := fileCreatorCleaner{}
 	defer func() {
 		cleanupErr := secretFileManager.Clean()
@@ -161,6 +180,31 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 		}
 	}()
 
+	var cacheReleases []func() error
+	defer func() {
+		for i := len(cacheReleases) - 1; i >= 0; i-- {
+			if releaseErr := cacheReleases[i](); err == nil && releaseErr != nil {
+				err = releaseErr
+			}
+		}
+	}()
+
+	mountCleaner := &runMountCleaner{}
+	defer func() {
+		if cleanupErr := mountCleaner.Clean(); err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	var sshCleanups []func() error
+	defer func() {
+		for i := len(sshCleanups) - 1; i >= 0; i-- {
+			if cleanupErr := sshCleanups[i](); err == nil && cleanupErr != nil {
+				err = cleanupErr
+			}
+		}
+	}()
+
 	mounts := instructions.GetMounts(cmdRun)
 	for _, mount := range mounts {
 		switch mount.Type {
@@ -171,7 +215,7 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 			envName := mount.CacheID
 			secret, secretSet := buildSecretsMap[envName]
 			if !secretSet && mount.Required {
-				return fmt.Errorf("required secret %s not found", mount.CacheID)
+				return nil, fmt.Errorf("required secret %s not found", mount.CacheID)
 			}
 
 			// If a target is specified, we write to the file specified by the target:
@@ -200,13 +244,93 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 			}
 
 			env = append(env, fmt.Sprintf("%s=%s", targetEnv, secret))
-		// NOTE(SasSwart):
-		// Buildkit v0.16.0 brought support for `RUN --mount` flags. Kaniko support for the mount
-		// types below is deferred until its needed.
-		// case instructions.MountTypeBind:
-		// case instructions.MountTypeTmpfs:
-		// case instructions.MountTypeCache:
-		// case instructions.MountTypeSSH
+		case instructions.MountTypeCache:
+			// Implemented as per:
+			// https://docs.docker.com/reference/dockerfile/#run---mounttypecache
+			if !filepath.IsAbs(mount.Target) {
+				return nil, fmt.Errorf("cache mount target %s must be absolute", mount.Target)
+			}
+
+			cacheDir, release, mountErr := mountCache(cmdRun, mount)
+			if mountErr != nil {
+				return nil, errors.Wrapf(mountErr, "mounting cache %s", mount.CacheID)
+			}
+			cacheReleases = append(cacheReleases, release)
+
+			if mounted, err := bindOrCopyMount(cacheDir, mount.Target, false); err != nil {
+				return nil, errors.Wrapf(err, "mounting cache directory at %s", mount.Target)
+			} else if mounted {
+				mountCleaner.bindsToUnmount = append(mountCleaner.bindsToUnmount, mount.Target)
+			}
+			excludedPaths = append(excludedPaths, mount.Target)
+		case instructions.MountTypeTmpfs:
+			// Implemented as per:
+			// https://docs.docker.com/reference/dockerfile/#run---mounttypetmpfs
+			if !filepath.IsAbs(mount.Target) {
+				return nil, fmt.Errorf("tmpfs mount target %s must be absolute", mount.Target)
+			}
+			if err := os.MkdirAll(mount.Target, 0o755); err != nil {
+				return nil, errors.Wrapf(err, "creating tmpfs mount target %s", mount.Target)
+			}
+
+			tmpfsOpts := ""
+			if mount.SizeLimit > 0 {
+				tmpfsOpts = fmt.Sprintf("size=%d", mount.SizeLimit)
+			}
+			if err := syscall.Mount("tmpfs", mount.Target, "tmpfs", 0, tmpfsOpts); err != nil {
+				return nil, errors.Wrapf(err, "mounting tmpfs at %s", mount.Target)
+			}
+			mountCleaner.tmpfsToUnmount = append(mountCleaner.tmpfsToUnmount, mount.Target)
+			excludedPaths = append(excludedPaths, mount.Target)
+		case instructions.MountTypeBind:
+			// Implemented as per:
+			// https://docs.docker.com/reference/dockerfile/#run---mounttypebind
+			if !filepath.IsAbs(mount.Target) {
+				return nil, fmt.Errorf("bind mount target %s must be absolute", mount.Target)
+			}
+
+			if mount.From != "" {
+				// mount.From names another build stage (e.g.
+				// `--mount=type=bind,from=builder,source=/app`). Resolving a
+				// stage's root requires the executor's stage bookkeeping,
+				// which this package has no access to, so silently falling
+				// back to the build context would bind-mount unrelated
+				// content. Fail loudly instead of doing the wrong thing.
+				return nil, fmt.Errorf("bind mount %s: mounting from build stage %q is not supported", mount.Target, mount.From)
+			}
+
+			source := mount.Source
+			if source == "" {
+				source = "."
+			}
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(kConfig.BuildContextDir, source)
+			}
+
+			if mounted, err := bindOrCopyMount(source, mount.Target, mount.ReadOnly); err != nil {
+				return nil, errors.Wrapf(err, "mounting bind source %s at %s", source, mount.Target)
+			} else if mounted {
+				mountCleaner.bindsToUnmount = append(mountCleaner.bindsToUnmount, mount.Target)
+			}
+			excludedPaths = append(excludedPaths, mount.Target)
+		case instructions.MountTypeSSH:
+			// Implemented as per:
+			// https://docs.docker.com/reference/dockerfile/#run---mounttypessh
+			sshUID, sshGID := os.Getuid(), os.Getgid()
+			if cmd.SysProcAttr.Credential != nil {
+				sshUID, sshGID = int(cmd.SysProcAttr.Credential.Uid), int(cmd.SysProcAttr.Credential.Gid)
+			}
+			socketPath, cleanup, sshErr := mountSSHAgent(mount, sshSourcesMap, sshUID, sshGID)
+			if sshErr != nil {
+				if mount.Required {
+					return nil, errors.Wrapf(sshErr, "mounting ssh agent %s", mount.CacheID)
+				}
+				logrus.Warnf("ssh agent %s not available: %v", mount.CacheID, sshErr)
+				continue
+			}
+			sshCleanups = append(sshCleanups, cleanup)
+			env = append(env, fmt.Sprintf("SSH_AUTH_SOCK=%s", socketPath))
+			excludedPaths = append(excludedPaths, socketPath)
 		default:
 			logrus.Warnf("Mount type %s is not supported", mount.Type)
 		}
@@ -216,22 +340,134 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 
 	logrus.Infof("Running: %s", cmd.Args)
 	if err := cmd.Start(); err != nil {
-		return errors.Wrap(err, "starting command")
+		return nil, errors.Wrap(err, "starting command")
 	}
 
 	pgid, err := syscall.Getpgid(cmd.Process.Pid)
 	if err != nil {
-		return errors.Wrap(err, "getting group id for process")
+		return nil, errors.Wrap(err, "getting group id for process")
 	}
 	if err := cmd.Wait(); err != nil {
-		return errors.Wrap(err, "waiting for process to exit")
+		return nil, errors.Wrap(err, "waiting for process to exit")
 	}
 
 	// it's not an error if there are no grandchildren
 	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err.Error() != "no such process" {
-		return err
+		return nil, err
 	}
-	return nil
+	return excludedPaths, nil
+}
+
+// mountCache resolves a `--mount=type=cache` mount to its backing
+// directory on disk, creating it on first use. The cache key folds in the
+// RUN command's own text so that reusing a cache id across two RUN
+// commands with different content doesn't cross-pollinate unless the
+// commands genuinely agree on what they're caching.
+func mountCache(cmdRun *instructions.RunCommand, mount *instructions.Mount) (string, func() error, error) {
+	sharing := cachemount.SharingShared
+	switch mount.CacheSharing {
+	case instructions.MountSharingPrivate:
+		sharing = cachemount.SharingPrivate
+	case instructions.MountSharingLocked:
+		sharing = cachemount.SharingLocked
+	}
+
+	var mode os.FileMode
+	if mount.Mode != nil {
+		mode = os.FileMode(*mount.Mode)
+	}
+	var uid, gid int
+	if mount.UID != nil {
+		uid = int(*mount.UID)
+	}
+	if mount.GID != nil {
+		gid = int(*mount.GID)
+	}
+
+	return sharedCacheMgr.Mount(cachemount.Options{
+		ID:             mount.CacheID,
+		Target:         mount.Target,
+		Sharing:        sharing,
+		Mode:           mode,
+		UID:            uid,
+		GID:            gid,
+		RunCommandHash: cachemount.Digest(cmdRun.String()),
+	})
+}
+
+// runFilesUsedFromContext returns the sorted, de-duplicated set of
+// build-context-relative paths that cmdRun's `--mount=type=bind` flags
+// read from. A literal source contributes itself; a wildcard source (e.g.
+// `source=./src/**/*.go`) is expanded against the build context and every
+// matched regular file is included individually, mirroring BuildKit's
+// ChecksumWildcard cache manager so that two RUNs binding the same glob
+// over different file sets get different cache keys. As with the bind
+// mount handling in runCommandInExec, a source naming another build stage
+// (mount.From) can't be resolved here - that's the executor's job - so
+// such mounts are rejected rather than silently hashed against the wrong
+// files.
+func runFilesUsedFromContext(cmdRun *instructions.RunCommand) ([]string, error) {
+	if cmdRun == nil {
+		return nil, nil
+	}
+
+	cc := contenthash.NewCacheContext(kConfig.BuildContextDir)
+
+	seen := make(map[string]bool)
+	var files []string
+	add := func(f string) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+
+	for _, mount := range instructions.GetMounts(cmdRun) {
+		if mount.Type != instructions.MountTypeBind {
+			continue
+		}
+		if mount.From != "" {
+			return nil, fmt.Errorf("bind mount %s: mounting from build stage %q is not supported", mount.Target, mount.From)
+		}
+
+		source := mount.Source
+		if source == "" {
+			source = "."
+		}
+		if filepath.IsAbs(source) {
+			continue
+		}
+		source = filepath.ToSlash(filepath.Clean(source))
+
+		if !strings.ContainsAny(source, "*?[") {
+			add(source)
+			continue
+		}
+
+		matches, err := cc.GlobFiles(source, contenthash.WildcardOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "expanding bind mount source %s", source)
+		}
+		for _, m := range matches {
+			add(m)
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// dirMetadata is a snapshot of a pre-existing directory's metadata, taken
+// just before fileCreatorCleaner widened its mode or ownership to be able
+// to write beneath it. Replaying these in reverse depth order restores the
+// directory exactly as fileCreatorCleaner found it.
+type dirMetadata struct {
+	path    string
+	mode    os.FileMode
+	uid     int
+	gid     int
+	modTime time.Time
+	xattrs  map[string]string
 }
 
 // fileCreatorCleaner keeps tracks of all files and directories that it created in the order that they were created.
@@ -239,6 +475,7 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 type fileCreatorCleaner struct {
 	filesToClean []string
 	dirsToClean  []string
+	journal      []dirMetadata
 }
 
 func (s *fileCreatorCleaner) MkdirAndWriteFile(path string, data []byte, dirPerm, filePerm os.FileMode) error {
@@ -255,11 +492,19 @@ func (s *fileCreatorCleaner) MkdirAndWriteFile(path string, data []byte, dirPerm
 		// Traverse one level down
 		currentPath = filepath.Join(currentPath, nextDirDown)
 
-		if _, err := filesystem.FS.Stat(currentPath); errors.Is(err, os.ErrNotExist) {
+		fi, err := filesystem.FS.Stat(currentPath)
+		if errors.Is(err, os.ErrNotExist) {
 			if err := filesystem.FS.Mkdir(currentPath, dirPerm); err != nil {
 				return err
 			}
 			s.dirsToClean = append(s.dirsToClean, currentPath)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.widenExistingDir(currentPath, fi, dirPerm); err != nil {
+			return err
 		}
 	}
 
@@ -272,6 +517,64 @@ func (s *fileCreatorCleaner) MkdirAndWriteFile(path string, data []byte, dirPerm
 	return nil
 }
 
+// widenExistingDir journals path's current mode, ownership, mtime and
+// xattrs, then chmods/chowns it so that a non-root build can still write
+// beneath a parent it doesn't otherwise have access to (kaniko frequently
+// builds under non-root and ends up mutating shared parents like /var or
+// /etc this way). It's a no-op if path already has dirPerm's permission
+// bits and is already owned by the current process. The setuid/setgid/
+// sticky bits, if any, are preserved across the widen - only the
+// permission bits are touched, so a setgid shared-group directory or a
+// sticky /tmp comes back exactly as it was found.
+func (s *fileCreatorCleaner) widenExistingDir(path string, fi os.FileInfo, dirPerm os.FileMode) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	const specialBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	wantMode := fi.Mode()&specialBits | fi.Mode().Perm() | dirPerm.Perm()
+	wantUID, wantGID := os.Getuid(), os.Getgid()
+	needsChmod := fi.Mode()&(specialBits|os.ModePerm) != wantMode
+	needsChown := int(st.Uid) != wantUID || int(st.Gid) != wantGID
+	if !needsChmod && !needsChown {
+		return nil
+	}
+
+	xattrs, err := copier.ReadXattrs(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading xattrs of %s", path)
+	}
+
+	s.journal = append(s.journal, dirMetadata{
+		path:    path,
+		mode:    fi.Mode() & (specialBits | os.ModePerm),
+		uid:     int(st.Uid),
+		gid:     int(st.Gid),
+		modTime: fi.ModTime(),
+		xattrs:  xattrs,
+	})
+
+	if needsChmod {
+		if err := filesystem.FS.Chmod(path, wantMode); err != nil {
+			return errors.Wrapf(err, "widening permissions of %s", path)
+		}
+	}
+	if needsChown {
+		if err := filesystem.FS.Chown(path, wantUID, wantGID); err != nil {
+			return errors.Wrapf(err, "changing ownership of %s", path)
+		}
+	}
+	return nil
+}
+
+// Journal returns the metadata snapshots captured for pre-existing
+// directories that had to be widened, in the order they were captured.
+// It's exposed for tests; Clean is the only caller that needs to replay it.
+func (s *fileCreatorCleaner) Journal() []dirMetadata {
+	return s.journal
+}
+
 func (s *fileCreatorCleaner) Clean() error {
 	for i := len(s.filesToClean) - 1; i >= 0; i-- {
 		if err := filesystem.FS.Remove(s.filesToClean[i]); err != nil {
@@ -292,9 +595,100 @@ func (s *fileCreatorCleaner) Clean() error {
 		}
 	}
 
+	// Restore widened parents last, deepest first, so a sibling a third
+	// party left behind under an outer directory (left alone above) doesn't
+	// block us from still reaching an inner directory we need to restore.
+	for i := len(s.journal) - 1; i >= 0; i-- {
+		m := s.journal[i]
+		if _, err := filesystem.FS.Lstat(m.path); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := filesystem.FS.Chown(m.path, m.uid, m.gid); err != nil {
+			return errors.Wrapf(err, "restoring ownership of %s", m.path)
+		}
+		if err := filesystem.FS.Chmod(m.path, m.mode); err != nil {
+			return errors.Wrapf(err, "restoring mode of %s", m.path)
+		}
+		if err := copier.WriteXattrs(m.path, m.xattrs); err != nil {
+			return errors.Wrapf(err, "restoring xattrs of %s", m.path)
+		}
+		if err := filesystem.FS.Chtimes(m.path, m.modTime, m.modTime); err != nil {
+			return errors.Wrapf(err, "restoring mtime of %s", m.path)
+		}
+	}
+
 	return nil
 }
 
+// rootfsLookupUser resolves u - a username or numeric UID, optionally
+// followed by ":<group>" as Dockerfile USER allows - against
+// ${kConfig.RootDir}/etc/passwd, the identity database the build itself
+// populates (e.g. via an earlier RUN useradd), rather than the host's:
+// by the time a USER instruction or RUN needs HOME resolved, the host's
+// accounts have nothing to do with the image's. It falls back to
+// util.LookupUser, which consults the host via os/user, only when the
+// rootfs has no /etc/passwd at all.
+func rootfsLookupUser(u string) (*user.User, error) {
+	name, _, _ := strings.Cut(u, ":")
+
+	f, err := filesystem.FS.Open(filepath.Join(kConfig.RootDir, "etc", "passwd"))
+	if errors.Is(err, os.ErrNotExist) {
+		return util.LookupUser(u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry, err := findPasswdEntry(f, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		return entry, nil
+	}
+
+	// No passwd entry - a numeric UID is still valid (it just owns no
+	// files in the rootfs's own database), in which case HOME is "/".
+	if _, numErr := strconv.Atoi(name); numErr == nil {
+		return &user.User{Username: name, Uid: name, Gid: name, HomeDir: "/"}, nil
+	}
+	return nil, user.UnknownUserError(name)
+}
+
+// findPasswdEntry scans a passwd-formatted reader (colon-delimited
+// name:passwd:uid:gid:gecos:home:shell records, blank lines and
+// "#"-comments ignored) for an entry matching name by username or, if
+// name is numeric, by UID. It returns a nil *user.User and nil error if
+// nothing matches, so the caller can tell "no file" from "no entry".
+func findPasswdEntry(r io.Reader, name string) (*user.User, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+		username, uid, gid, home := fields[0], fields[2], fields[3], fields[5]
+		if username != name && uid != name {
+			continue
+		}
+
+		if home == "" {
+			home = "/"
+		}
+		return &user.User{Username: username, Uid: uid, Gid: gid, HomeDir: home}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
 // addDefaultHOME adds the default value for HOME if it isn't already set
 func addDefaultHOME(u string, envs []string) ([]string, error) {
 	for _, env := range envs {
@@ -332,6 +726,24 @@ func (r *RunCommand) ProvidesFilesToSnapshot() bool {
 	return false
 }
 
+// ExcludedPaths returns paths that must not be captured in the layer
+// snapshot taken after this RUN: the targets of its cache, tmpfs and bind
+// mounts and the sockets of its ssh mounts. None of that content belongs
+// in the resulting image (cache mount content lives under kConfig.CacheDir
+// across RUNs/builds).
+func (r *RunCommand) ExcludedPaths() []string {
+	return r.excludedPaths
+}
+
+// FilesUsedFromContext returns the build-context-relative paths that this
+// RUN's `--mount=type=bind` sources read from, so changing one of them
+// busts the cache the same way a changed COPY source would. It overrides
+// BaseCommand's default (always empty), which is otherwise indistinguishable
+// from "this RUN has no bind mounts".
+func (r *RunCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	return runFilesUsedFromContext(r.cmd)
+}
+
 // CacheCommand returns true since this command should be cached
 func (r *RunCommand) CacheCommand(img v1.Image) DockerCommand {
 	return &CachingRunCommand{
@@ -440,6 +852,67 @@ func (cr *CachingRunCommand) MetadataOnly() bool {
 	return false
 }
 
+// FilesUsedFromContext mirrors RunCommand's: a cached RUN still binds the
+// same context paths a fresh one would, and the two need to agree so that
+// replaying from a cached layer doesn't diverge from the cache key a fresh
+// execution would have produced.
+func (cr *CachingRunCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	return runFilesUsedFromContext(cr.cmd)
+}
+
+// bindOrCopyMount makes the contents of src visible at target, preferring
+// a bind mount (so writes land back in src) and falling back to a
+// recursive copy if bind mounts aren't usable in the current environment
+// (e.g. an unprivileged build). target is created if it doesn't exist.
+// mounted reports whether target is now a real mount point that the caller
+// must unmount; it is false when bindOrCopyMount fell back to a copy.
+func bindOrCopyMount(src, target string, readonly bool) (mounted bool, err error) {
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return false, errors.Wrap(err, "creating mount target")
+	}
+
+	flags := uintptr(syscall.MS_BIND)
+	if err := syscall.Mount(src, target, "", flags, ""); err != nil {
+		logrus.Debugf("bind mount of %s at %s failed (%v), falling back to copy", src, target, err)
+		return false, copyTree(src, target)
+	}
+
+	if readonly {
+		flags |= syscall.MS_REMOUNT | syscall.MS_RDONLY
+		if err := syscall.Mount(src, target, "", flags, ""); err != nil {
+			return true, errors.Wrap(err, "remounting bind mount read-only")
+		}
+	}
+
+	return true, nil
+}
+
+// copyTree recursively materializes src into dst. It's used as a fallback
+// for mount types that would normally be bind mounts when the current
+// environment doesn't permit mount(2) (e.g. an unprivileged build).
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode())
+	})
+}
+
 // todo: this should create the workdir if it doesn't exist, atleast this is what docker does
 func setWorkDirIfExists(workdir string) string {
 	if _, err := filesystem.FS.Lstat(workdir); err == nil {
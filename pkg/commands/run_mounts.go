@@ -0,0 +1,53 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// runMountCleaner tears down the tmpfs and bind mounts a RUN command set up
+// for its `--mount` flags, once the command has finished. It mirrors
+// fileCreatorCleaner's "only undo what we did" approach, just for mount(2)
+// rather than the filesystem.
+type runMountCleaner struct {
+	tmpfsToUnmount []string
+	bindsToUnmount []string
+}
+
+// Clean unmounts everything this cleaner recorded, in reverse order so that
+// mounts nested under other mounts come off first. It keeps going on error
+// so a single stuck mount doesn't strand the rest, returning the first error
+// seen.
+func (c *runMountCleaner) Clean() error {
+	var firstErr error
+
+	unmountAll := func(targets []string) {
+		for i := len(targets) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(targets[i], 0); err != nil && firstErr == nil {
+				firstErr = errors.Wrapf(err, "unmounting %s", targets[i])
+			}
+		}
+	}
+
+	unmountAll(c.bindsToUnmount)
+	unmountAll(c.tmpfsToUnmount)
+
+	return firstErr
+}
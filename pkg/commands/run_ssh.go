@@ -0,0 +1,189 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentDir is where forwarded/in-process ssh agent sockets are created,
+// mirroring BuildKit's /run/buildkit/ssh_agent.<id> convention so tooling
+// that shells out and inspects $SSH_AUTH_SOCK behaves the same as it would
+// under `docker build`.
+const sshAgentDir = "/run/buildkit"
+
+// parseSSHSources turns the repeated `--ssh` flag values (parallel to
+// `--build-secrets`) into a map from ssh mount id to source. A bare id
+// with no "=" (typically "default") means "use $SSH_AUTH_SOCK" for that
+// id; an "id=path" entry points at either a private key file or an
+// existing agent socket.
+func parseSSHSources(sshFlags []string) (map[string]string, error) {
+	sources := make(map[string]string)
+	for _, s := range sshFlags {
+		id, source, found := strings.Cut(s, "=")
+		if !found {
+			id = s
+			source = ""
+		}
+		if id == "" {
+			return nil, fmt.Errorf("invalid --ssh value %q", s)
+		}
+		sources[id] = source
+	}
+	return sources, nil
+}
+
+// mountSSHAgent resolves a `--mount=type=ssh` mount to a unix socket that
+// speaks the ssh-agent protocol, creating it if necessary, and returns a
+// cleanup function that must be called once the RUN command exits. uid and
+// gid are the credentials the RUN command itself is about to execute under
+// (see runCommandInExec's cmd.SysProcAttr.Credential) - the socket and its
+// containing directory are chowned to them so a non-root RUN user can still
+// reach the agent it was just handed.
+func mountSSHAgent(mount *instructions.Mount, sources map[string]string, uid, gid int) (socketPath string, cleanup func() error, err error) {
+	id := mount.CacheID
+	if id == "" {
+		id = "default"
+	}
+
+	source, ok := sources[id]
+	if !ok {
+		return "", nil, fmt.Errorf("no --ssh source provided for id %s", id)
+	}
+
+	if source == "" {
+		source = os.Getenv("SSH_AUTH_SOCK")
+		if source == "" {
+			return "", nil, fmt.Errorf("--ssh %s has no path but $SSH_AUTH_SOCK is not set", id)
+		}
+	}
+
+	if err := os.MkdirAll(sshAgentDir, 0o700); err != nil {
+		return "", nil, errors.Wrap(err, "creating ssh agent socket directory")
+	}
+	if err := os.Chown(sshAgentDir, uid, gid); err != nil {
+		return "", nil, errors.Wrapf(err, "changing ownership of %s", sshAgentDir)
+	}
+	socketPath = filepath.Join(sshAgentDir, fmt.Sprintf("ssh_agent.%s", id))
+	_ = os.Remove(socketPath)
+
+	var cleanupFn func() error
+	if fi, statErr := os.Stat(source); statErr == nil && fi.Mode()&os.ModeSocket != 0 {
+		socketPath, cleanupFn, err = proxySSHAgent(socketPath, source)
+	} else {
+		socketPath, cleanupFn, err = serveSSHKey(socketPath, source)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := os.Chown(socketPath, uid, gid); err != nil {
+		cleanupFn()
+		return "", nil, errors.Wrapf(err, "changing ownership of ssh agent socket %s", socketPath)
+	}
+
+	return socketPath, cleanupFn, nil
+}
+
+// proxySSHAgent listens on socketPath and forwards every connection
+// byte-for-byte to the existing agent socket at hostSocket (typically the
+// host's $SSH_AUTH_SOCK).
+func proxySSHAgent(socketPath, hostSocket string) (string, func() error, error) {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "listening on %s", socketPath)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go proxySSHConn(conn, hostSocket)
+		}
+	}()
+
+	return socketPath, func() error {
+		l.Close()
+		return os.Remove(socketPath)
+	}, nil
+}
+
+func proxySSHConn(conn net.Conn, hostSocket string) {
+	defer conn.Close()
+	upstream, err := net.Dial("unix", hostSocket)
+	if err != nil {
+		logrus.Warnf("ssh agent forwarding: dialing %s: %v", hostSocket, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, upstream); done <- struct{}{} }()
+	<-done
+}
+
+// serveSSHKey loads the private key at keyPath and serves it from an
+// in-process ssh-agent keyring at socketPath.
+func serveSSHKey(socketPath, keyPath string) (string, func() error, error) {
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "reading ssh key %s", keyPath)
+	}
+	key, err := ssh.ParseRawPrivateKey(keyBytes)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "parsing ssh key %s", keyPath)
+	}
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		return "", nil, errors.Wrap(err, "adding key to in-process ssh agent")
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "listening on %s", socketPath)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	return socketPath, func() error {
+		l.Close()
+		return os.Remove(socketPath)
+	}, nil
+}
@@ -24,15 +24,52 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
 
+	kConfig "github.com/GoogleContainerTools/kaniko/pkg/config"
 	"github.com/GoogleContainerTools/kaniko/pkg/dockerfile"
 	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
 	"github.com/GoogleContainerTools/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/pkg/errors"
 )
 
+// mustParseRun parses a single `RUN ...` Dockerfile line into an
+// *instructions.RunCommand, so tests can build mounts the same way the
+// real Dockerfile parser does instead of hand-constructing instructions.Mount
+// values.
+func mustParseRun(t *testing.T, line string) *instructions.RunCommand {
+	t.Helper()
+	result, err := parser.Parse(strings.NewReader(line))
+	if err != nil {
+		t.Fatalf("parsing %q: %v", line, err)
+	}
+	cmd, err := instructions.ParseCommand(result.AST.Children[0])
+	if err != nil {
+		t.Fatalf("parsing instruction %q: %v", line, err)
+	}
+	run, ok := cmd.(*instructions.RunCommand)
+	if !ok {
+		t.Fatalf("expected *instructions.RunCommand, got %T", cmd)
+	}
+	return run
+}
+
+// withBuildContextDir points kConfig.BuildContextDir at dir for the
+// duration of the test, restoring the previous value on cleanup.
+func withBuildContextDir(t *testing.T, dir string) {
+	t.Helper()
+	original := kConfig.BuildContextDir
+	kConfig.BuildContextDir = dir
+	t.Cleanup(func() { kConfig.BuildContextDir = original })
+}
+
 func Test_addDefaultHOME(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -123,7 +160,93 @@ func Test_addDefaultHOME(t *testing.T) {
 	}
 }
 
-func prepareTarFixture(t *testing.T, fileNames []string) ([]byte, error) {
+// withRootDir points kConfig.RootDir at dir for the duration of the test,
+// restoring the previous value on cleanup.
+func withRootDir(t *testing.T, dir string) {
+	t.Helper()
+	original := kConfig.RootDir
+	kConfig.RootDir = dir
+	t.Cleanup(func() { kConfig.RootDir = original })
+}
+
+func Test_rootfsLookupUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		passwd   string // omit the file entirely if nil-equivalent sentinel "-"
+		user     string
+		expected *user.User
+		wantErr  bool
+	}{
+		{
+			name: "user created earlier in the Dockerfile",
+			passwd: "root:x:0:0:root:/root:/bin/bash\n" +
+				"www-add:x:1001:1001::/home/www-add:/bin/sh\n",
+			user:     "www-add",
+			expected: &user.User{Username: "www-add", Uid: "1001", Gid: "1001", HomeDir: "/home/www-add"},
+		},
+		{
+			name:     "numeric UID with no matching passwd entry",
+			passwd:   "root:x:0:0:root:/root:/bin/bash\n",
+			user:     "1001",
+			expected: &user.User{Username: "1001", Uid: "1001", Gid: "1001", HomeDir: "/"},
+		},
+		{
+			name:    "unknown non-numeric user with no matching passwd entry",
+			passwd:  "root:x:0:0:root:/root:/bin/bash\n",
+			user:    "ghost",
+			wantErr: true,
+		},
+		{
+			name: "passwd entry with an empty home field",
+			passwd: "root:x:0:0:root:/root:/bin/bash\n" +
+				"nobody:x:65534:65534:nobody::/usr/sbin/nologin\n",
+			user:     "nobody",
+			expected: &user.User{Username: "nobody", Uid: "65534", Gid: "65534", HomeDir: "/"},
+		},
+		{
+			// No fixture is written for this case, so rootfsLookupUser falls
+			// back to util.LookupUser, i.e. the host's own os/user.Lookup -
+			// exercised against whatever user actually exists on the host
+			// running this test, "root", rather than a canned expectation.
+			name:   "rootfs with no /etc/passwd falls back to host",
+			passwd: "-",
+			user:   "root",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			withRootDir(t, root)
+
+			if test.passwd != "-" {
+				passwdPath := filepath.Join(root, "etc", "passwd")
+				if err := filesystem.FS.MkdirAll(filepath.Dir(passwdPath), 0755); err != nil {
+					t.Fatalf("creating /etc: %v", err)
+				}
+				if err := filesystem.WriteFile(passwdPath, []byte(test.passwd), 0644); err != nil {
+					t.Fatalf("writing passwd fixture: %v", err)
+				}
+			} else {
+				want, err := user.Lookup(test.user)
+				if err != nil {
+					t.Skipf("host has no %q user to fall back to: %v", test.user, err)
+				}
+				test.expected = want
+			}
+
+			actual, err := rootfsLookupUser(test.user)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, actual)
+		})
+	}
+}
+
+func prepareTarFixture(t *testing.T, fileNames []string) ([]byte, string, error) {
 	dir := t.TempDir()
 
 	content := `
@@ -132,7 +255,7 @@ meow meow meow meow
 `
 	for _, name := range fileNames {
 		if err := filesystem.WriteFile(filepath.Join(dir, name), []byte(content), 0o777); err != nil {
-			return nil, err
+			return nil, "", err
 		}
 	}
 	writer := bytes.NewBuffer([]byte{})
@@ -165,14 +288,15 @@ meow meow meow meow
 		return nil
 	})
 
-	return writer.Bytes(), nil
+	return writer.Bytes(), dir, nil
 }
 
 func Test_CachingRunCommand_ExecuteCommand(t *testing.T) {
-	tarContent, err := prepareTarFixture(t, []string{"foo.txt"})
+	tarContent, contextDir, err := prepareTarFixture(t, []string{"foo.txt"})
 	if err != nil {
 		t.Errorf("couldn't prepare tar fixture %v", err)
 	}
+	withBuildContextDir(t, contextDir)
 
 	config := &v1.Config{}
 	buildArgs := &dockerfile.BuildArgs{}
@@ -196,6 +320,7 @@ func Test_CachingRunCommand_ExecuteCommand(t *testing.T) {
 					},
 				},
 			}
+			c.cmd = mustParseRun(t, `RUN --mount=type=bind,source=foo.txt,target=/foo.txt cat /foo.txt`)
 			count := 0
 			tc := testCase{
 				desctiption:    "with valid image and valid layer",
@@ -288,9 +413,9 @@ func Test_CachingRunCommand_ExecuteCommand(t *testing.T) {
 					}
 				}
 
-				// CachingRunCommand does not override BaseCommand
-				// FilesUseFromContext so this will always return an empty slice and no error
-				// This seems like it might be a bug as it results in RunCommands and CachingRunCommands generating different cache keys - cvgw - 2019-11-27
+				// CachingRunCommand now overrides BaseCommand's FilesUsedFromContext,
+				// computing the same bind-mount sources RunCommand would, so a
+				// cached and a fresh run of the same RUN agree on cache key inputs.
 				cmdFiles, err := c.FilesUsedFromContext(
 					config, buildArgs,
 				)
@@ -298,8 +423,12 @@ func Test_CachingRunCommand_ExecuteCommand(t *testing.T) {
 					t.Errorf("failed to get files used from context from command")
 				}
 
-				if len(cmdFiles) != 0 {
-					t.Errorf("expected files used from context to be empty but was not")
+				gotFiles := append([]string{}, cmdFiles...)
+				wantFiles := append([]string{}, tc.contextFiles...)
+				sort.Strings(gotFiles)
+				sort.Strings(wantFiles)
+				if !reflect.DeepEqual(gotFiles, wantFiles) {
+					t.Errorf("expected files used from context to be %v but was %v", wantFiles, gotFiles)
 				}
 			}
 
@@ -312,6 +441,150 @@ func Test_CachingRunCommand_ExecuteCommand(t *testing.T) {
 	}
 }
 
+func Test_FilesUsedFromContext_BindMountWildcards(t *testing.T) {
+	config := &v1.Config{}
+	buildArgs := &dockerfile.BuildArgs{}
+
+	testCases := []struct {
+		desctiption  string
+		contextFiles map[string]string
+		runLine      string
+		want         []string
+	}{
+		{
+			desctiption:  "no matches",
+			contextFiles: map[string]string{"README.md": "docs"},
+			runLine:      `RUN --mount=type=bind,source=./src/**/*.go,target=/src go build ./...`,
+			want:         nil,
+		},
+		{
+			desctiption:  "single match",
+			contextFiles: map[string]string{"src/main.go": "package main"},
+			runLine:      `RUN --mount=type=bind,source=./src/**/*.go,target=/src go build ./...`,
+			want:         []string{"src/main.go"},
+		},
+		{
+			desctiption: "deep glob",
+			contextFiles: map[string]string{
+				"src/main.go":           "package main",
+				"src/pkg/helper.go":     "package pkg",
+				"src/pkg/deep/impl.go":  "package deep",
+				"src/pkg/deep/impl.txt": "not go",
+			},
+			runLine: `RUN --mount=type=bind,source=./src/**/*.go,target=/src go build ./...`,
+			want:    []string{"src/main.go", "src/pkg/deep/impl.go", "src/pkg/helper.go"},
+		},
+		{
+			desctiption: "mixed files and dirs",
+			contextFiles: map[string]string{
+				"src/main.go":     "package main",
+				"src/testdata/go": "not a real go file, just a regular file named 'go' under a subdirectory",
+			},
+			runLine: `RUN --mount=type=bind,source=./src/**,target=/src go build ./...`,
+			want:    []string{"src/main.go", "src/testdata/go"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desctiption, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tc.contextFiles {
+				full := filepath.Join(dir, filepath.FromSlash(name))
+				if err := filesystem.FS.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := filesystem.WriteFile(full, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			withBuildContextDir(t, dir)
+
+			cmd := mustParseRun(t, tc.runLine)
+			run := &RunCommand{cmd: cmd}
+			caching := &CachingRunCommand{cmd: cmd}
+
+			for name, cmdFiles := range map[string]func() ([]string, error){
+				"RunCommand":        func() ([]string, error) { return run.FilesUsedFromContext(config, buildArgs) },
+				"CachingRunCommand": func() ([]string, error) { return caching.FilesUsedFromContext(config, buildArgs) },
+			} {
+				got, err := cmdFiles()
+				if err != nil {
+					t.Fatalf("%s.FilesUsedFromContext: %v", name, err)
+				}
+				want := append([]string{}, tc.want...)
+				got = append([]string{}, got...)
+				sort.Strings(want)
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: expected files used from context to be %v, got %v", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_FilesUsedFromContext_EqualContentDifferentMode(t *testing.T) {
+	config := &v1.Config{}
+	buildArgs := &dockerfile.BuildArgs{}
+
+	dir := t.TempDir()
+	if err := filesystem.FS.MkdirAll(filepath.Join(dir, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := filesystem.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	withBuildContextDir(t, dir)
+
+	cmd := mustParseRun(t, `RUN --mount=type=bind,source=./src/**/*.go,target=/src go build ./...`)
+	run := &RunCommand{cmd: cmd}
+
+	files, err := run.FilesUsedFromContext(config, buildArgs)
+	if err != nil {
+		t.Fatalf("FilesUsedFromContext: %v", err)
+	}
+	if want := []string{"src/main.go"}; !reflect.DeepEqual(files, want) {
+		t.Fatalf("expected %v, got %v", want, files)
+	}
+
+	// The file list itself doesn't change when only the mode does - the
+	// content-sensitivity that makes an identical-bytes-different-mode
+	// source bust the cache lives in contenthash's per-file digest, which
+	// folds in mode alongside content (see
+	// Test_ChecksumWildcard_EqualContentDifferentMode in the contenthash
+	// package). FilesUsedFromContext's job is only to report which paths a
+	// downstream hasher needs to look at.
+	if err := filesystem.FS.Chmod(filepath.Join(dir, "src", "main.go"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	filesAfterChmod, err := run.FilesUsedFromContext(config, buildArgs)
+	if err != nil {
+		t.Fatalf("FilesUsedFromContext: %v", err)
+	}
+	if !reflect.DeepEqual(files, filesAfterChmod) {
+		t.Fatalf("expected the matched file set to be unaffected by a mode change, got %v vs %v", files, filesAfterChmod)
+	}
+}
+
+func Test_BindMountFrom_Rejected(t *testing.T) {
+	config := &v1.Config{}
+	buildArgs := &dockerfile.BuildArgs{}
+
+	dir := t.TempDir()
+	withBuildContextDir(t, dir)
+
+	cmd := mustParseRun(t, `RUN --mount=type=bind,from=builder,source=/app,target=/app go build ./...`)
+
+	run := &RunCommand{cmd: cmd}
+	if _, err := run.FilesUsedFromContext(config, buildArgs); err == nil {
+		t.Fatal("expected FilesUsedFromContext to reject a bind mount with from=, got nil error")
+	}
+
+	if _, err := runCommandInExec(&v1.Config{}, buildArgs, cmd, nil, nil, nil); err == nil {
+		t.Fatal("expected runCommandInExec to reject a bind mount with from=, got nil error")
+	}
+}
+
 func TestFileCreatorCleaner(t *testing.T) {
 	const (
 		fileContent = "content"
@@ -444,6 +717,184 @@ func TestFileCreatorCleaner(t *testing.T) {
 			t.Fatalf("expected directory to not be removed, but it was")
 		}
 	})
+
+	t.Run("Widened pre-existing directory permissions are restored", func(t *testing.T) {
+		dir := t.TempDir()
+		preExisting := filepath.Join(dir, "a")
+		if err := os.Mkdir(preExisting, 0555); err != nil {
+			t.Fatalf("creating pre-existing directory: %v", err)
+		}
+
+		fcc := fileCreatorCleaner{}
+
+		// Given a fileCreatorCleaner writes beneath a pre-existing directory
+		// that doesn't have dirMode's permission bits
+		file := filepath.Join(preExisting, "b", "file")
+		if err := fcc.MkdirAndWriteFile(file, []byte(fileContent), dirMode, fileMode); err != nil {
+			t.Fatalf("creating file using fileCreatorCleaner: %v", err)
+		}
+
+		// Then the pre-existing directory should have been widened to include dirMode's bits
+		info, err := os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := os.FileMode(0755); info.Mode().Perm() != want {
+			t.Fatalf("expected widened mode to be %v, but got %v", want, info.Mode().Perm())
+		}
+
+		// When fileCreatorCleaner.Clean is called
+		if err := fcc.Clean(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Then the pre-existing directory should be restored to its original mode
+		info, err = os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := os.FileMode(0555); info.Mode().Perm() != want {
+			t.Fatalf("expected mode to be restored to %v, but got %v", want, info.Mode().Perm())
+		}
+
+		// And the pre-existing directory itself should still be there, since we didn't create it
+		if _, err := os.Stat(preExisting); err != nil {
+			t.Fatalf("expected pre-existing directory to remain, but got: %v", err)
+		}
+	})
+
+	t.Run("Widened pre-existing directory setgid/sticky bits are preserved", func(t *testing.T) {
+		dir := t.TempDir()
+		preExisting := filepath.Join(dir, "a")
+		// 0555 with the setgid and sticky bits set, e.g. a shared-group dir
+		// under /var or a sticky /tmp.
+		if err := os.Mkdir(preExisting, 0555|os.ModeSetgid|os.ModeSticky); err != nil {
+			t.Fatalf("creating pre-existing directory: %v", err)
+		}
+
+		fcc := fileCreatorCleaner{}
+
+		// Given a fileCreatorCleaner writes beneath a pre-existing directory
+		// that doesn't have dirMode's permission bits
+		file := filepath.Join(preExisting, "b", "file")
+		if err := fcc.MkdirAndWriteFile(file, []byte(fileContent), dirMode, fileMode); err != nil {
+			t.Fatalf("creating file using fileCreatorCleaner: %v", err)
+		}
+
+		// Then the pre-existing directory should have been widened to include
+		// dirMode's bits, with the setgid/sticky bits left untouched
+		info, err := os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := os.FileMode(0755) | os.ModeSetgid | os.ModeSticky; info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky) != want {
+			t.Fatalf("expected widened mode to be %v, but got %v", want, info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+		}
+
+		// When fileCreatorCleaner.Clean is called
+		if err := fcc.Clean(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Then the pre-existing directory should be restored to its original
+		// mode, setgid and sticky bits included
+		info, err = os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := os.FileMode(0555) | os.ModeSetgid | os.ModeSticky; info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky) != want {
+			t.Fatalf("expected mode to be restored to %v, but got %v", want, info.Mode()&(os.ModePerm|os.ModeSetgid|os.ModeSticky))
+		}
+	})
+
+	t.Run("Widened pre-existing directory ownership is restored", func(t *testing.T) {
+		if os.Getuid() != 0 {
+			t.Skip("chowning to an arbitrary uid requires running as root")
+		}
+
+		dir := t.TempDir()
+		preExisting := filepath.Join(dir, "a")
+		if err := os.Mkdir(preExisting, dirMode); err != nil {
+			t.Fatalf("creating pre-existing directory: %v", err)
+		}
+		if err := os.Chown(preExisting, 1000, 1000); err != nil {
+			t.Fatalf("chowning pre-existing directory: %v", err)
+		}
+
+		fcc := fileCreatorCleaner{}
+
+		// Given a fileCreatorCleaner writes beneath a pre-existing directory owned by another uid
+		file := filepath.Join(preExisting, "b", "file")
+		if err := fcc.MkdirAndWriteFile(file, []byte(fileContent), dirMode, fileMode); err != nil {
+			t.Fatalf("creating file using fileCreatorCleaner: %v", err)
+		}
+
+		// Then the pre-existing directory should have been chowned to the current process
+		info, err := os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if int(st.Uid) != os.Getuid() {
+			t.Fatalf("expected directory to be chowned to %d, but got %d", os.Getuid(), st.Uid)
+		}
+
+		// When fileCreatorCleaner.Clean is called
+		if err := fcc.Clean(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Then the pre-existing directory should be restored to its original owner
+		info, err = os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		st = info.Sys().(*syscall.Stat_t)
+		if st.Uid != 1000 {
+			t.Fatalf("expected ownership to be restored to uid 1000, but got %d", st.Uid)
+		}
+	})
+
+	t.Run("Widened outer directory is restored even when a third party left a sibling behind", func(t *testing.T) {
+		dir := t.TempDir()
+		preExisting := filepath.Join(dir, "a")
+		if err := os.Mkdir(preExisting, 0555); err != nil {
+			t.Fatalf("creating pre-existing directory: %v", err)
+		}
+
+		fcc := fileCreatorCleaner{}
+
+		// Given a fileCreatorCleaner has created a file two directories below the pre-existing one
+		file := filepath.Join(preExisting, "b", "file")
+		if err := fcc.MkdirAndWriteFile(file, []byte(fileContent), dirMode, fileMode); err != nil {
+			t.Fatalf("creating file using fileCreatorCleaner: %v", err)
+		}
+
+		// And a third party file is created in the same inner directory
+		thirdPartyFile := filepath.Join(preExisting, "b", "third-party-file")
+		if err := filesystem.WriteFile(thirdPartyFile, []byte(fileContent), fileMode); err != nil {
+			t.Fatalf("creating third party file %v", err)
+		}
+
+		// When fileCreatorCleaner.Clean is called
+		if err := fcc.Clean(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Then the inner directory should survive, since the third party file still lives there
+		if _, err := os.Stat(filepath.Join(preExisting, "b")); errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected directory to not be removed, but it was")
+		}
+
+		// And the outer, pre-existing directory should still have its mode restored
+		info, err := os.Stat(preExisting)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := os.FileMode(0555); info.Mode().Perm() != want {
+			t.Fatalf("expected mode to be restored to %v, but got %v", want, info.Mode().Perm())
+		}
+	})
 }
 
 func TestSetWorkDirIfExists(t *testing.T) {
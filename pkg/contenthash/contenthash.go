@@ -0,0 +1,264 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package contenthash implements a per-source content-hash cache for COPY
+// layer cache keys, mirroring BuildKit's contenthash package. A COPY
+// layer's cache key should depend on the content of the paths it copies,
+// not on the tarball bytes that happen to get produced while writing them
+// out - mtimes, entry ordering and sparse-file metadata all show up in a
+// tarball without changing what gets copied, and would otherwise bust an
+// otherwise-valid cache hit.
+//
+// A CacheContext keeps one entry per path relative to its root: a file or
+// symlink gets a single digest; a directory gets two, one for its own
+// header (stored under the path with a trailing "/") and one folding in
+// the digests of everything beneath it (stored under the bare path), so
+// that invalidating a file bubbles up to every ancestor directory's
+// recursive digest without having to touch siblings. This is the same key
+// scheme BuildKit's contenthash keeps in an immutable radix tree; the
+// entries here are small enough in practice that a plain map with a mutex
+// gives the same answers without the extra machinery.
+package contenthash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/copier"
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// Entry is one cached digest, plus enough of the Lstat it was computed
+// from to tell whether it's still valid.
+type Entry struct {
+	Digest  digest.Digest
+	ModTime time.Time
+	Size    int64
+	Ino     uint64
+}
+
+// CacheContext is a content-hash cache rooted at a single source
+// directory (typically KanikoOptions.SrcContext). It is safe for
+// concurrent use.
+type CacheContext struct {
+	root string
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewCacheContext returns an empty CacheContext rooted at root. Every path
+// passed to Checksum or Invalidate is resolved relative to root.
+func NewCacheContext(root string) *CacheContext {
+	return &CacheContext{
+		root:    root,
+		entries: make(map[string]*Entry),
+	}
+}
+
+// Checksum returns the content digest of root-relative path p: a plain
+// SHA256 over mode|uid|gid|size|content for a regular file, the same
+// fields but the link target in place of content for a symlink, or a
+// digest folding in every entry beneath it for a directory. Results are
+// cached and only recomputed once Lstat reports a different mtime, size
+// or inode for p (or an ancestor invalidates it).
+func (c *CacheContext) Checksum(ctx context.Context, p string) (digest.Digest, error) {
+	return c.checksum(ctx, cleanRel(p))
+}
+
+// Invalidate drops the cached digest for root-relative path p, along with
+// everything beneath it (if p is a directory) and the recursive digest of
+// every ancestor of p, so the next Checksum call recomputes exactly the
+// entries that could have changed.
+func (c *CacheContext) Invalidate(p string) {
+	rel := cleanRel(p)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rel == "" {
+		clear(c.entries)
+		return
+	}
+
+	prefix := rel + "/"
+	for key := range c.entries {
+		if key == rel || strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+
+	// Every ancestor's recursive digest folded this path in, so it must
+	// be recomputed too. Its own header is untouched, since that only
+	// reflects the ancestor's own mode/uid/gid, not its contents.
+	for dir := path.Dir(rel); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		delete(c.entries, dir)
+	}
+	delete(c.entries, ".")
+}
+
+func cleanRel(p string) string {
+	return path.Clean("/" + filepath.ToSlash(p))[1:]
+}
+
+func (c *CacheContext) lookup(key string) (*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *CacheContext) store(key string, e *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+func (c *CacheContext) checksum(ctx context.Context, rel string) (digest.Digest, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	full, err := copier.SecureJoin(c.root, rel)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving %s", rel)
+	}
+	fi, err := filesystem.FS.Lstat(full)
+	if err != nil {
+		return "", errors.Wrapf(err, "stat %s", rel)
+	}
+	st := statOf(fi)
+
+	key := rel
+	if key == "" {
+		key = "."
+	}
+
+	if cached, ok := c.lookup(key); ok && cached.ModTime.Equal(st.ModTime) && cached.Size == st.Size && cached.Ino == st.Ino {
+		return cached.Digest, nil
+	}
+
+	var sum digest.Digest
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := filesystem.FS.Readlink(full)
+		if err != nil {
+			return "", errors.Wrapf(err, "readlink %s", rel)
+		}
+		sum = hashHeader(fi, int64(len(target)), []byte(target))
+	case fi.IsDir():
+		headerSum := hashHeader(fi, 0, nil)
+		headerKey := key + "/"
+		if key == "." {
+			headerKey = "/"
+		}
+		c.store(headerKey, &Entry{Digest: headerSum, ModTime: st.ModTime, Size: st.Size, Ino: st.Ino})
+
+		names, err := readDirNames(full)
+		if err != nil {
+			return "", errors.Wrapf(err, "reading directory %s", rel)
+		}
+		sort.Strings(names)
+
+		h := sha256.New()
+		fmt.Fprintf(h, "header:%s\n", headerSum)
+		for _, name := range names {
+			childRel := path.Join(rel, name)
+			childSum, err := c.checksum(ctx, childRel)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s:%s\n", name, childSum)
+		}
+		sum = digest.NewDigestFromBytes(digest.SHA256, h.Sum(nil))
+	default:
+		f, err := filesystem.FS.Open(full)
+		if err != nil {
+			return "", errors.Wrapf(err, "opening %s", rel)
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		header := headerBytes(fi, fi.Size())
+		h.Write(header)
+		if _, err := io.Copy(h, f); err != nil {
+			return "", errors.Wrapf(err, "hashing %s", rel)
+		}
+		sum = digest.NewDigestFromBytes(digest.SHA256, h.Sum(nil))
+	}
+
+	c.store(key, &Entry{Digest: sum, ModTime: st.ModTime, Size: st.Size, Ino: st.Ino})
+	return sum, nil
+}
+
+// headerBytes serializes mode|uid|gid|size, the fixed prefix every
+// content digest (file, symlink or directory header) is built from.
+func headerBytes(fi os.FileInfo, size int64) []byte {
+	uid, gid := ownerOf(fi)
+	return fmt.Appendf(nil, "mode=%d\x00uid=%d\x00gid=%d\x00size=%d\x00", fi.Mode(), uid, gid, size)
+}
+
+// hashHeader hashes headerBytes followed by content (a symlink's target
+// string, or nothing for a directory's own header).
+func hashHeader(fi os.FileInfo, size int64, content []byte) digest.Digest {
+	h := sha256.New()
+	h.Write(headerBytes(fi, size))
+	h.Write(content)
+	return digest.NewDigestFromBytes(digest.SHA256, h.Sum(nil))
+}
+
+type stamp struct {
+	ModTime time.Time
+	Size    int64
+	Ino     uint64
+}
+
+func statOf(fi os.FileInfo) stamp {
+	s := stamp{ModTime: fi.ModTime(), Size: fi.Size()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		s.Ino = st.Ino
+	}
+	return s
+}
+
+func ownerOf(fi os.FileInfo) (uid, gid int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return 0, 0
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := filesystem.FS.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+func Test_Checksum_StableAcrossMtimeOnly(t *testing.T) {
+	root := t.TempDir()
+	if err := filesystem.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCacheContext(root)
+	ctx := context.Background()
+	sum1, err := c.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+
+	// Changing only the mtime must not change the digest. A fresh
+	// CacheContext is used so the digest is recomputed from scratch rather
+	// than served from the first context's cached entry.
+	mtime := time.Now().Add(-time.Hour)
+	if err := filesystem.FS.Chtimes(filepath.Join(root, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	c2 := NewCacheContext(root)
+	sum2, err := c2.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+	if sum1 != sum2 {
+		t.Errorf("expected stable digest, got %s and %s", sum1, sum2)
+	}
+}
+
+func Test_Checksum_ChangesWithContent(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "a.txt")
+	if err := filesystem.WriteFile(p, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCacheContext(root)
+	ctx := context.Background()
+	before, err := c.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+
+	if err := filesystem.WriteFile(p, []byte("goodbye"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate("a.txt")
+
+	after, err := c.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+	if before == after {
+		t.Errorf("expected digest to change with content, got %s both times", before)
+	}
+}
+
+func Test_Checksum_DirectoryFoldsChildren(t *testing.T) {
+	root := t.TempDir()
+	if err := filesystem.FS.Mkdir(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := filesystem.WriteFile(filepath.Join(root, "dir", "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCacheContext(root)
+	ctx := context.Background()
+	before, err := c.Checksum(ctx, "dir")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+
+	if err := filesystem.WriteFile(filepath.Join(root, "dir", "a.txt"), []byte("goodbye"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate("dir/a.txt")
+
+	after, err := c.Checksum(ctx, "dir")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+	if before == after {
+		t.Errorf("expected directory digest to change when a child's content changes")
+	}
+}
+
+func Test_SaveLoad_RoundTrip(t *testing.T) {
+	root := t.TempDir()
+	if err := filesystem.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	c := NewCacheContext(root)
+	ctx := context.Background()
+	want, err := c.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+	if err := c.Save(cacheDir); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	loaded, err := Load(cacheDir, root)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if _, ok := loaded.lookup("a.txt"); !ok {
+		t.Fatal("expected loaded cache to already have an entry for a.txt")
+	}
+	got, err := loaded.Checksum(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Checksum: %s", err)
+	}
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
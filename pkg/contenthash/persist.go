@@ -0,0 +1,74 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// FileName is the name Load and Save persist the cache under, inside
+// whatever directory the caller gives them (typically config.KanikoDir,
+// so a warm CI runner doesn't have to rewalk the whole build context on
+// every invocation).
+const FileName = "contenthash.gob"
+
+// Load reads a previously Saved CacheContext for root from dir. A missing
+// file is not an error: it returns a fresh, empty CacheContext, since the
+// cache is just an optimization over recomputing digests from scratch.
+func Load(dir, root string) (*CacheContext, error) {
+	c := NewCacheContext(root)
+
+	data, err := filesystem.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, errors.Wrapf(err, "reading %s", filepath.Join(dir, FileName))
+	}
+
+	var entries map[string]*Entry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entries); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", filepath.Join(dir, FileName))
+	}
+	c.entries = entries
+	return c, nil
+}
+
+// Save writes c's entries to dir, so a later Load can pick up where this
+// run left off instead of recomputing every digest from scratch.
+func (c *CacheContext) Save(dir string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c.entries); err != nil {
+		return errors.Wrap(err, "encoding content-hash cache")
+	}
+
+	path := filepath.Join(dir, FileName)
+	if err := filesystem.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return errors.Wrapf(err, "writing %s", path)
+	}
+	return nil
+}
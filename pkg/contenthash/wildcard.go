@@ -0,0 +1,223 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/copier"
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// NoMatchesError is returned by ChecksumWildcard when pattern doesn't
+// match any path under the CacheContext's root, so callers can tell that
+// apart from "matched files, but their digest isn't in the layer cache".
+type NoMatchesError struct {
+	Pattern string
+}
+
+func (e *NoMatchesError) Error() string {
+	return fmt.Sprintf("contenthash: pattern %q matched no files", e.Pattern)
+}
+
+// WildcardOptions configures ChecksumWildcard.
+type WildcardOptions struct {
+	// Ignore, if set, is consulted for every path under root and excludes
+	// it from the match set if it returns true - the hook a caller wires
+	// up to its own .dockerignore handling.
+	Ignore func(relPath string) bool
+}
+
+// ChecksumWildcard expands pattern against the CacheContext's root using
+// the same "**" (match any number of path segments) plus per-segment
+// filepath.Match semantics kaniko's COPY command uses to resolve glob
+// sources, then folds every matched path's Checksum into one digest.
+// pattern may list several whitespace-separated sources, as a multi-source
+// COPY does; the union of their matches is folded. The pattern string
+// itself, and each match's path, are mixed into the digest, so `COPY *.txt`
+// and an equivalent `COPY a.txt b.txt` produce different cache keys even
+// though they'd copy the same files.
+//
+// Matches are sorted lexically before folding, so the result doesn't
+// depend on directory walk order.
+func (c *CacheContext) ChecksumWildcard(ctx context.Context, pattern string, opts WildcardOptions) (digest.Digest, error) {
+	var matches []string
+	seen := make(map[string]bool)
+	for _, source := range strings.Fields(pattern) {
+		sourceMatches, err := c.glob(source, opts)
+		if err != nil {
+			return "", err
+		}
+		for _, m := range sourceMatches {
+			if !seen[m] {
+				seen[m] = true
+				matches = append(matches, m)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return "", &NoMatchesError{Pattern: pattern}
+	}
+	sort.Strings(matches)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "pattern:%s\n", pattern)
+	for _, m := range matches {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		sum, err := c.checksum(ctx, m)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s:%s\n", m, sum)
+	}
+	return digest.NewDigestFromBytes(digest.SHA256, h.Sum(nil)), nil
+}
+
+// glob returns every root-relative path matching pattern, in the order
+// they're encountered by a filesystem walk (ChecksumWildcard is
+// responsible for sorting).
+func (c *CacheContext) glob(pattern string, opts WildcardOptions) ([]string, error) {
+	pattern = cleanRel(pattern)
+
+	var matches []string
+	err := filesystem.WalkDir(c.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, relErr := filepath.Rel(c.root, path)
+		if relErr != nil {
+			return relErr
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if opts.Ignore != nil && opts.Ignore(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if matchDoublestar(pattern, rel) {
+			matches = append(matches, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "expanding %s", pattern)
+	}
+	return matches, nil
+}
+
+// GlobFiles is like glob, but restricted to the regular files pattern
+// matches: a directory that happens to match (e.g. `**/build` matching a
+// `build/` directory) is walked into but not reported itself, since a
+// caller folding these into a cache key digest only cares about content
+// that was actually read. A symlink whose target would resolve outside
+// root is skipped rather than followed - "files used from context" should
+// never reach past the build context boundary. Results are sorted, so the
+// return value doesn't depend on walk order.
+func (c *CacheContext) GlobFiles(pattern string, opts WildcardOptions) ([]string, error) {
+	matches, err := c.glob(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, m := range matches {
+		full, err := copier.SecureJoin(c.root, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving %s", m)
+		}
+		fi, err := filesystem.FS.Lstat(full)
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat %s", m)
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := filesystem.FS.Readlink(full)
+			if err != nil {
+				return nil, errors.Wrapf(err, "readlink %s", m)
+			}
+			if escapesRoot(c.root, filepath.Dir(full), target) {
+				continue
+			}
+		}
+		files = append(files, m)
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// escapesRoot reports whether target, read from a symlink living in dir,
+// resolves - lexically, the components need not exist - outside root.
+func escapesRoot(root, dir, target string) bool {
+	resolved := target
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(dir, resolved)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(resolved))
+	if err != nil {
+		return true
+	}
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// matchDoublestar reports whether name matches pattern, where pattern may
+// contain "**" path segments (matching zero or more segments, including
+// across directory boundaries) in addition to the single-segment
+// metacharacters filepath.Match already understands.
+func matchDoublestar(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		if matchSegments(pattern[1:], name) {
+			return true
+		}
+		return len(name) > 0 && matchSegments(pattern, name[1:])
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], name[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package contenthash
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if err := filesystem.FS.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := filesystem.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_ChecksumWildcard_NoMatches(t *testing.T) {
+	root := t.TempDir()
+	c := NewCacheContext(root)
+
+	_, err := c.ChecksumWildcard(context.Background(), "*.txt", WildcardOptions{})
+	var nme *NoMatchesError
+	if !errors.As(err, &nme) {
+		t.Fatalf("expected a *NoMatchesError, got %v", err)
+	}
+}
+
+func Test_ChecksumWildcard_DoubleStar(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a.txt":        "a",
+		"sub/b.txt":    "b",
+		"sub/deep/c.c": "c",
+	})
+
+	c := NewCacheContext(root)
+	sum, err := c.ChecksumWildcard(context.Background(), "**/*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("ChecksumWildcard: %s", err)
+	}
+	if sum == "" {
+		t.Fatal("expected a non-empty digest")
+	}
+}
+
+func Test_ChecksumWildcard_PatternVsExplicitSources(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a.txt": "a",
+		"b.txt": "b",
+	})
+
+	c := NewCacheContext(root)
+	ctx := context.Background()
+
+	globSum, err := c.ChecksumWildcard(ctx, "*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("ChecksumWildcard: %s", err)
+	}
+
+	// A multi-source COPY of the exact same two files should fold the
+	// same per-file digests, but mix in a different "pattern" - the
+	// literal source list - so it doesn't collide with the glob form.
+	explicitSum, err := c.ChecksumWildcard(ctx, "a.txt b.txt", WildcardOptions{
+		Ignore: func(relPath string) bool { return relPath != "a.txt" && relPath != "b.txt" },
+	})
+	if err != nil {
+		t.Fatalf("ChecksumWildcard: %s", err)
+	}
+
+	if globSum == explicitSum {
+		t.Errorf("expected glob and explicit-source cache keys to differ, both were %s", globSum)
+	}
+}
+
+func Test_ChecksumWildcard_IgnoreFiltered(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"keep.txt":        "keep",
+		"ignored/skip.go": "skip",
+	})
+
+	c := NewCacheContext(root)
+	ignore := func(relPath string) bool {
+		return strings.HasPrefix(relPath, "ignored/")
+	}
+
+	matches, err := c.glob("**", WildcardOptions{Ignore: ignore})
+	if err != nil {
+		t.Fatalf("glob: %s", err)
+	}
+	for _, m := range matches {
+		if strings.HasPrefix(m, "ignored/") {
+			t.Errorf("expected ignored/ to be filtered out, got match %s", m)
+		}
+	}
+
+	found := false
+	for _, m := range matches {
+		if m == "keep.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected keep.txt to match, matches were %v", matches)
+	}
+}
+
+func Test_GlobFiles_NoMatches(t *testing.T) {
+	root := t.TempDir()
+	c := NewCacheContext(root)
+
+	matches, err := c.GlobFiles("*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %s", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("expected no matches, got %v", matches)
+	}
+}
+
+func Test_GlobFiles_SingleMatch(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"a.txt": "a",
+		"b.go":  "b",
+	})
+
+	c := NewCacheContext(root)
+	matches, err := c.GlobFiles("*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %s", err)
+	}
+	if want := []string{"a.txt"}; !equalStringSlices(matches, want) {
+		t.Errorf("expected %v, got %v", want, matches)
+	}
+}
+
+func Test_GlobFiles_DeepGlob(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"src/a.go":           "a",
+		"src/pkg/b.go":       "b",
+		"src/pkg/deep/c.go":  "c",
+		"src/pkg/deep/d.txt": "d",
+	})
+
+	c := NewCacheContext(root)
+	matches, err := c.GlobFiles("src/**/*.go", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %s", err)
+	}
+	want := []string{"src/a.go", "src/pkg/b.go", "src/pkg/deep/c.go"}
+	if !equalStringSlices(matches, want) {
+		t.Errorf("expected %v, got %v", want, matches)
+	}
+}
+
+func Test_GlobFiles_MixedFilesAndDirs(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"build/output.bin": "bin",
+		"build/nested/x":   "x",
+	})
+
+	c := NewCacheContext(root)
+	matches, err := c.GlobFiles("**", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("GlobFiles: %s", err)
+	}
+	want := []string{"build/nested/x", "build/output.bin"}
+	if !equalStringSlices(matches, want) {
+		t.Errorf("expected directories to be excluded, got %v", matches)
+	}
+}
+
+func Test_ChecksumWildcard_EqualContentDifferentMode(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"a.txt": "same content"})
+	full := filepath.Join(root, "a.txt")
+	if err := filesystem.FS.Chmod(full, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCacheContext(root)
+	before, err := c.ChecksumWildcard(context.Background(), "*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("ChecksumWildcard: %s", err)
+	}
+
+	c.Invalidate("a.txt")
+	if err := filesystem.FS.Chmod(full, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := c.ChecksumWildcard(context.Background(), "*.txt", WildcardOptions{})
+	if err != nil {
+		t.Fatalf("ChecksumWildcard: %s", err)
+	}
+
+	if before == after {
+		t.Errorf("expected digest to change when mode changes despite identical content, both were %s", before)
+	}
+}
+
+func equalStringSlices(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
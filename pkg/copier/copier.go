@@ -0,0 +1,188 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package copier implements chrooted, uid/gid-mapped file copy primitives,
+// modeled on containers/buildah's pkg/copier. Every operation takes a path
+// relative to a Chroot's Root and resolves it with SecureJoin before
+// touching the filesystem, so callers (COPY/ADD command implementations,
+// the RUN --mount=type=cache snapshotter) get the same "can't escape the
+// build root via a symlink" guarantee no matter what untrusted content
+// they're walking.
+//
+// The package intentionally has no dependency on pkg/commands: it is
+// reusable by both the executor and anything else that needs to move files
+// into or out of a rootfs, such as the cache-mount snapshotter.
+package copier
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// IDMap mirrors a single line of /proc/.../uid_map: ContainerID values
+// starting at ContainerID and running for Size map onto HostID values
+// starting at HostID.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// IDPair is a uid/gid pair, already resolved to whichever namespace the
+// caller wants (host or container).
+type IDPair struct {
+	UID int
+	GID int
+}
+
+// IDMappingOptions describes how container-side uids/gids map onto the
+// host. A nil map means "no remapping" (container and host ids are equal).
+type IDMappingOptions struct {
+	UIDMap []IDMap
+	GIDMap []IDMap
+}
+
+func mapID(id int, idMap []IDMap) int {
+	for _, m := range idMap {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + (id - m.ContainerID)
+		}
+	}
+	return id
+}
+
+// toHost maps a container-side uid/gid pair to the host ids that should
+// actually own the file on disk.
+func (o IDMappingOptions) toHost(pair IDPair) IDPair {
+	return IDPair{
+		UID: mapID(pair.UID, o.UIDMap),
+		GID: mapID(pair.GID, o.GIDMap),
+	}
+}
+
+// Chroot scopes Get, Put, Stat, Mkdir and Remove to Root: every path they
+// accept is resolved with SecureJoin(Root, path) before use, and every
+// uid/gid they're given is remapped from container space to host space via
+// IDMappingOptions before it's applied to disk.
+type Chroot struct {
+	// Root is the directory all paths are resolved relative to, typically
+	// kConfig.RootDir for copying into or out of the image being built, or
+	// some other root such as a cache mount directory. It has no default:
+	// New sets it to the root it is given, and an empty Root resolves
+	// paths relative to the current working directory.
+	Root string
+
+	IDMappingOptions
+
+	// PreserveXattrs, if set, carries extended attributes along with Get
+	// (as tar PAXRecords) and restores them on Put.
+	PreserveXattrs bool
+}
+
+// New returns a Chroot rooted at root with no id remapping.
+func New(root string) *Chroot {
+	return &Chroot{Root: root}
+}
+
+// StatInfo is the subset of file metadata Stat reports, resolved safely
+// through the chroot's root.
+type StatInfo struct {
+	// Path is the path that was resolved, exactly as passed to Stat.
+	Path      string
+	IsDir     bool
+	IsSymlink bool
+	Size      int64
+	Mode      fs.FileMode
+	ModTime   time.Time
+}
+
+// Stat resolves path within c.Root and reports its metadata, without
+// following a trailing symlink (matching os.Lstat semantics).
+func (c *Chroot) Stat(path string) (*StatInfo, error) {
+	full, err := SecureJoin(c.Root, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolving %s", path)
+	}
+	fi, err := filesystem.FS.Lstat(full)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat %s", path)
+	}
+	return &StatInfo{
+		Path:      path,
+		IsDir:     fi.IsDir(),
+		IsSymlink: fi.Mode()&os.ModeSymlink != 0,
+		Size:      fi.Size(),
+		Mode:      fi.Mode(),
+		ModTime:   fi.ModTime(),
+	}, nil
+}
+
+// Mkdir creates path and any missing parents within c.Root, chowning the
+// leaf directory (and any parents it had to create) to owner, mapped from
+// container to host ids via c.IDMappingOptions.
+func (c *Chroot) Mkdir(path string, mode os.FileMode, owner IDPair) error {
+	full, err := SecureJoin(c.Root, path)
+	if err != nil {
+		return errors.Wrapf(err, "resolving %s", path)
+	}
+
+	host := c.toHost(owner)
+
+	// Walk up to find the first already-existing ancestor, so we only
+	// chown the directories this call actually creates.
+	created := []string{}
+	for dir := full; ; dir = filepath.Dir(dir) {
+		if _, err := filesystem.FS.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "stat %s", dir)
+		}
+		created = append(created, dir)
+		if dir == c.Root || dir == string(filepath.Separator) || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	if err := filesystem.FS.MkdirAll(full, mode); err != nil {
+		return errors.Wrapf(err, "mkdir %s", path)
+	}
+
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := os.Chown(created[i], host.UID, host.GID); err != nil {
+			return errors.Wrapf(err, "chown %s", created[i])
+		}
+	}
+	return nil
+}
+
+// Remove deletes path (recursively, if it is a directory) from within
+// c.Root.
+func (c *Chroot) Remove(path string) error {
+	full, err := SecureJoin(c.Root, path)
+	if err != nil {
+		return errors.Wrapf(err, "resolving %s", path)
+	}
+	if err := filesystem.FS.RemoveAll(full); err != nil {
+		return errors.Wrapf(err, "removing %s", path)
+	}
+	return nil
+}
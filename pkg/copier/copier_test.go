@@ -0,0 +1,171 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+func hasPathPrefix(path, prefix string) bool {
+	return strings.HasPrefix(filepath.Clean(path)+string(filepath.Separator), prefix)
+}
+
+func Test_SecureJoin_StaysWithinRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := filesystem.WriteFile(filepath.Join(root, "secret"), []byte("top secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	if err := filesystem.WriteFile(filepath.Join(outside, "secret"), []byte("host secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := filesystem.FS.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	escape := filepath.Join(root, "sub", "escape")
+	if err := filesystem.FS.Symlink(outside, escape); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := SecureJoin(root, "sub/escape/secret")
+	if err != nil {
+		t.Fatalf("SecureJoin: %s", err)
+	}
+	// The symlink's absolute target must be re-rooted at root (the same
+	// semantics a chroot gives an absolute symlink), so the result must
+	// stay under root rather than reaching into outside.
+	rootWithSep := filepath.Clean(root) + string(filepath.Separator)
+	if !hasPathPrefix(resolved, rootWithSep) {
+		t.Errorf("expected resolved path to stay under %s, got %s", root, resolved)
+	}
+	if hasPathPrefix(resolved, filepath.Clean(outside)+string(filepath.Separator)) {
+		t.Errorf("resolved path escaped into outside: %s", resolved)
+	}
+
+	resolvedAbs, err := SecureJoin(root, "../../../../etc/passwd")
+	if err != nil {
+		t.Fatalf("SecureJoin: %s", err)
+	}
+	if filepath.Clean(resolvedAbs) != filepath.Join(root, "etc", "passwd") {
+		t.Errorf("expected .. escape to be clamped to %s, got %s", filepath.Join(root, "etc", "passwd"), resolvedAbs)
+	}
+}
+
+func Test_Chroot_Get_GlobDoesNotEscapeThroughSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := filesystem.WriteFile(filepath.Join(outside, "secret.txt"), []byte("host secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A symlink inside root pointing at a directory outside it - the
+	// wildcard component a pattern like "*/secret.txt" would otherwise
+	// match straight through via filepath.Glob's unguarded traversal.
+	if err := filesystem.FS.Symlink(outside, filepath.Join(root, "evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(root)
+	var out bytes.Buffer
+	err := c.Get([]string{"*/secret.txt"}, &out)
+
+	// The symlink's target is re-rooted at root (the same chroot
+	// semantics SecureJoin gives any other symlink), so there is no
+	// "root/evil/secret.txt" inside root to find, and Get must fail
+	// rather than quietly tar up the host's file.
+	if err == nil {
+		t.Fatal("expected Get to fail rather than follow the symlink outside root")
+	}
+}
+
+func Test_Chroot_MkdirRemoveStat(t *testing.T) {
+	root := t.TempDir()
+	c := New(root)
+
+	if err := c.Mkdir("a/b/c", 0o755, IDPair{}); err != nil {
+		t.Fatalf("Mkdir: %s", err)
+	}
+	info, err := c.Stat("a/b/c")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if !info.IsDir {
+		t.Errorf("expected a/b/c to be a directory")
+	}
+
+	if err := c.Remove("a"); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected a to be removed, stat err = %v", err)
+	}
+}
+
+func Test_Chroot_PutGetRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	c := New(root)
+
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	content := []byte("hello from copier\n")
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "greeting.txt",
+		Mode: 0o644,
+		Size: int64(len(content)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put(&in, PutOptions{}); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	var out bytes.Buffer
+	if err := c.Get([]string{"greeting.txt"}, &out); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	tr := tar.NewReader(&out)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading tar entry: %s", err)
+	}
+	if hdr.Name != "greeting.txt" {
+		t.Errorf("expected entry name greeting.txt, got %s", hdr.Name)
+	}
+	gotContent := make([]byte, len(content))
+	if _, err := tr.Read(gotContent); err != nil {
+		t.Fatalf("reading entry content: %s", err)
+	}
+	if string(gotContent) != string(content) {
+		t.Errorf("expected content %q, got %q", content, gotContent)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// devIno identifies a file by its device and inode, the same key
+// archive/tar's own writer uses internally to recognize hardlinks.
+type devIno struct {
+	dev, ino uint64
+}
+
+// Get writes a tar stream to w containing every path within c.Root that
+// matches one of patterns (plain paths match themselves; paths containing
+// glob metacharacters are expanded with filepath.Glob). Entry names are
+// relative to c.Root. A file seen more than once under the same device and
+// inode - two patterns matching the same hardlinked file, or a directory
+// copy that walks into one - is written once in full and linked to by name
+// afterwards, matching how AddFileToTar already handles hardlinks.
+func (c *Chroot) Get(patterns []string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	seen := map[devIno]string{}
+
+	for _, pattern := range patterns {
+		full, err := SecureJoin(c.Root, pattern)
+		if err != nil {
+			return errors.Wrapf(err, "resolving %s", pattern)
+		}
+
+		matches := []string{full}
+		if hasMeta(pattern) {
+			matches, err = c.glob(full)
+			if err != nil {
+				return errors.Wrapf(err, "expanding %s", pattern)
+			}
+		}
+
+		for _, m := range matches {
+			if err := c.addTree(tw, m, seen); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// hasMeta reports whether pattern contains any filepath.Glob metacharacter.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[`)
+}
+
+// glob expands full - an already root-joined (but, since it contains a
+// wildcard, not symlink-resolved) pattern - and re-resolves every match
+// through SecureJoin before returning it. filepath.Glob does its own
+// unguarded directory traversal and follows symlinks wherever they lead,
+// so taking its matches at face value would let a symlink planted inside
+// c.Root (e.g. "evil -> /etc") escape containment via a pattern like
+// "*/secret.txt" - exactly the class of bug SecureJoin exists to close
+// for non-wildcard paths. Re-resolving clamps every match back inside
+// c.Root the same way a literal path would be.
+func (c *Chroot) glob(full string) ([]string, error) {
+	rawMatches, err := filepath.Glob(full)
+	if err != nil {
+		return nil, err
+	}
+
+	safe := make([]string, 0, len(rawMatches))
+	for _, m := range rawMatches {
+		rel, err := filepath.Rel(c.Root, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "relativizing glob match %s", m)
+		}
+		resolved, err := SecureJoin(c.Root, rel)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving glob match %s", m)
+		}
+		safe = append(safe, resolved)
+	}
+	return safe, nil
+}
+
+// addTree adds full (and, if it is a directory, everything beneath it) to
+// tw, deduplicating hardlinks via seen.
+func (c *Chroot) addTree(tw *tar.Writer, full string, seen map[devIno]string) error {
+	return filesystem.Walk(full, func(path string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "walking %s", path)
+		}
+		return c.addFile(tw, path, fi, seen)
+	})
+}
+
+func (c *Chroot) addFile(tw *tar.Writer, path string, fi fs.FileInfo, seen map[devIno]string) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = filesystem.FS.Readlink(path)
+		if err != nil {
+			return errors.Wrapf(err, "readlink %s", path)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return errors.Wrapf(err, "building tar header for %s", path)
+	}
+	rel, err := filepath.Rel(c.Root, path)
+	if err != nil {
+		return errors.Wrapf(err, "relativizing %s", path)
+	}
+	hdr.Name = filepath.ToSlash(rel)
+
+	if c.PreserveXattrs {
+		records, err := ReadXattrs(path)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			hdr.PAXRecords = records
+			hdr.Format = tar.FormatPAX
+		}
+	}
+
+	if fi.Mode().IsRegular() {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := devIno{dev: uint64(st.Dev), ino: st.Ino}
+			if original, ok := seen[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = original
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			seen[key] = hdr.Name
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "writing tar header for %s", path)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := filesystem.FS.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return errors.Wrapf(err, "writing %s to tar", path)
+	}
+	return nil
+}
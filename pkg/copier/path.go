@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// maxSymlinks bounds how many symlinks SecureJoin will follow while
+// resolving a single path, mirroring the limit the kernel itself enforces
+// (Linux's MAXSYMLINKS), so a cycle of symlinks fails fast instead of
+// looping forever.
+const maxSymlinks = 255
+
+// SecureJoin resolves unsafePath as if it were opened from inside a chroot
+// rooted at root: every path component is resolved in turn, and any
+// symlink, ".." or absolute component is re-anchored at root rather than
+// being allowed to walk out of it. This is the same algorithm Moby's
+// symlink.FollowSymlinkInScope and buildah's copier package use to keep a
+// symlink planted by untrusted layer or build-context content (a
+// surprisingly common CVE class - see CVE-2018-15664, CVE-2021-21285) from
+// making a copy operation read or write outside of root.
+//
+// The returned path is always of the form filepath.Join(root, something);
+// it never escapes root even if unsafePath tries to, and it does not
+// require unsafePath to exist - non-existent trailing components are
+// preserved verbatim so callers like Mkdir and Put can resolve a
+// not-yet-created destination.
+func SecureJoin(root, unsafePath string) (string, error) {
+	root = path.Clean(root)
+
+	remaining := splitPath(unsafePath)
+	resolved := "" // always root-relative, without a leading slash
+
+	links := 0
+	for len(remaining) > 0 {
+		comp := remaining[0]
+		remaining = remaining[1:]
+
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			resolved = parentOf(resolved)
+			continue
+		}
+
+		candidate := joinRel(resolved, comp)
+		full := path.Join(root, candidate)
+
+		fi, err := filesystem.FS.Lstat(full)
+		if err != nil {
+			if os.IsNotExist(err) {
+				resolved = candidate
+				continue
+			}
+			return "", errors.Wrapf(err, "resolving %s", full)
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = candidate
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.Errorf("too many levels of symbolic links resolving %s", unsafePath)
+		}
+
+		target, err := filesystem.FS.Readlink(full)
+		if err != nil {
+			return "", errors.Wrapf(err, "reading symlink %s", full)
+		}
+		if path.IsAbs(target) {
+			remaining = append(splitPath(target), remaining...)
+			resolved = ""
+		} else {
+			remaining = append(splitPath(target), remaining...)
+			// target is relative to candidate's parent, which is exactly
+			// the resolved prefix we had before descending into comp.
+		}
+	}
+
+	return path.Join(root, resolved), nil
+}
+
+// splitPath splits p into its non-empty components, treating it as an
+// absolute path regardless of whether it starts with "/".
+func splitPath(p string) []string {
+	return strings.Split(path.Clean("/"+p), "/")
+}
+
+// joinRel joins a root-relative path (no leading slash) with the next
+// component, returning another root-relative path.
+func joinRel(resolved, comp string) string {
+	return strings.TrimPrefix(path.Join("/", resolved, comp), "/")
+}
+
+// parentOf returns the root-relative parent of a root-relative path,
+// clamped at "" (root) rather than ever producing "..".
+func parentOf(resolved string) string {
+	return strings.TrimPrefix(path.Dir("/"+resolved), "/")
+}
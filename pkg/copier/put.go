@@ -0,0 +1,139 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+)
+
+// PutOptions controls how Put materializes a tar stream inside a Chroot.
+type PutOptions struct {
+	// Chown, if non-nil, overrides every entry's on-disk owner with this
+	// container-side id (mapped to host space the same way Mkdir does),
+	// implementing COPY/ADD's `--chown`. A nil Chown preserves each
+	// entry's own uid/gid from the tar header, mapped individually.
+	Chown *IDPair
+}
+
+// Put extracts the tar stream read from r into c.Root. Every entry name is
+// resolved with SecureJoin before anything is created, so a maliciously
+// crafted "../../etc/passwd" entry (a "tar slip", CVE-2018-1002204 and
+// friends) lands inside c.Root instead of escaping it.
+func (c *Chroot) Put(r io.Reader, opts PutOptions) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading tar entry")
+		}
+		if err := c.putEntry(tr, hdr, opts); err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+}
+
+func (c *Chroot) putEntry(tr *tar.Reader, hdr *tar.Header, opts PutOptions) error {
+	full, err := SecureJoin(c.Root, hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	owner := IDPair{UID: hdr.Uid, GID: hdr.Gid}
+	if opts.Chown != nil {
+		owner = *opts.Chown
+	}
+	host := c.toHost(owner)
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := filesystem.FS.MkdirAll(full, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := filesystem.FS.Symlink(hdr.Linkname, full); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := SecureJoin(c.Root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := filesystem.FS.Link(target, full); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := filesystem.FS.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			return err
+		}
+		f, err := filesystem.FS.OpenFile(full, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(f, tr)
+		closeErr := f.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	default:
+		// Device nodes, fifos and the like aren't something COPY/ADD ever
+		// produce; skip rather than fail the whole extraction on them.
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chown(full, host.UID, host.GID); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeLink {
+			if err := os.Chmod(full, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(hdr.PAXRecords) > 0 {
+		if err := WriteXattrs(full, hdr.PAXRecords); err != nil {
+			return err
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeLink {
+		mtime := hdr.ModTime
+		if mtime.IsZero() {
+			mtime = time.Unix(0, 0)
+		}
+		if err := os.Chtimes(full, mtime, mtime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
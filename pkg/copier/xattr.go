@@ -0,0 +1,85 @@
+//go:build linux
+
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// xattrPAXPrefix namespaces extended attributes inside a tar entry's
+// PAXRecords, the same convention GNU tar and buildah's copier use, so
+// that a tarball produced by Get and consumed by Put (or by any other
+// PAX-aware tar reader) round-trips xattrs without a custom entry type.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// ReadXattrs returns path's extended attributes as PAX records.
+func ReadXattrs(path string) (map[string]string, error) {
+	names, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "listing xattrs for %s", path)
+	}
+	if names == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, names)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing xattrs for %s", path)
+	}
+
+	records := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:n]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading xattr %s of %s", name, path)
+		}
+		val := make([]byte, size)
+		if size > 0 {
+			if _, err := unix.Lgetxattr(path, name, val); err != nil {
+				return nil, errors.Wrapf(err, "reading xattr %s of %s", name, path)
+			}
+		}
+		records[xattrPAXPrefix+name] = string(val)
+	}
+	return records, nil
+}
+
+// WriteXattrs restores the PAX records produced by ReadXattrs onto path.
+func WriteXattrs(path string, records map[string]string) error {
+	for key, val := range records {
+		name, ok := strings.CutPrefix(key, xattrPAXPrefix)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, []byte(val), 0); err != nil {
+			return errors.Wrapf(err, "restoring xattr %s of %s", name, path)
+		}
+	}
+	return nil
+}
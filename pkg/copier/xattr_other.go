@@ -0,0 +1,31 @@
+//go:build !linux
+
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package copier
+
+// ReadXattrs and WriteXattrs are no-ops outside Linux: xattrs simply
+// aren't preserved there, the same as the rest of kaniko's non-Linux
+// support.
+
+func ReadXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func WriteXattrs(path string, records map[string]string) error {
+	return nil
+}
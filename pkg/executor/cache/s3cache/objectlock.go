@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ObjectLockFlags mirrors the raw --cache-s3-object-lock-* flag values.
+// Kaniko's cache objects are content-addressed and never rewritten, which
+// makes them a natural fit for S3 Object Lock: a layer written once can be
+// made untamperable and undeletable for a retention window.
+type ObjectLockFlags struct {
+	// Mode is --cache-s3-object-lock-mode, "GOVERNANCE" or "COMPLIANCE".
+	Mode string
+	// Days is --cache-s3-object-lock-days: every object this Pusher
+	// writes is retained until Days days after the push that wrote it.
+	Days int
+	// LegalHold is --cache-s3-object-lock-legal-hold, "on" or "off".
+	LegalHold string
+}
+
+// ObjectLock is ObjectLockFlags, parsed into the types a PutObjectInput
+// actually wants.
+type ObjectLock struct {
+	Mode            types.ObjectLockMode
+	RetainDays      int
+	LegalHoldStatus types.ObjectLockLegalHoldStatus
+}
+
+// ParseObjectLock validates f and returns the ObjectLock it describes.
+// An all-zero ObjectLockFlags parses to an all-zero ObjectLock whose
+// apply is a no-op.
+func ParseObjectLock(f ObjectLockFlags) (*ObjectLock, error) {
+	if f.Days < 0 {
+		return nil, errors.Errorf("s3cache: --cache-s3-object-lock-days must be >= 0, got %d", f.Days)
+	}
+	if f.Days > 0 && f.Mode == "" {
+		return nil, errors.New("s3cache: --cache-s3-object-lock-days requires --cache-s3-object-lock-mode")
+	}
+
+	l := &ObjectLock{Mode: types.ObjectLockMode(f.Mode), RetainDays: f.Days}
+
+	switch strings.ToLower(f.LegalHold) {
+	case "":
+	case "on":
+		l.LegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	case "off":
+		l.LegalHoldStatus = types.ObjectLockLegalHoldStatusOff
+	default:
+		return nil, errors.Errorf("s3cache: --cache-s3-object-lock-legal-hold must be \"on\" or \"off\", got %q", f.LegalHold)
+	}
+
+	return l, nil
+}
+
+// apply sets l's fields onto in. RetainUntilDate is computed at push
+// time, now plus RetainDays, rather than parsed from a flag - a fixed
+// retention window applied to every object a long-running kaniko process
+// pushes instead of just the first.
+func (l ObjectLock) apply(in *s3.PutObjectInput) {
+	if l.Mode != "" {
+		in.ObjectLockMode = l.Mode
+	}
+	if l.RetainDays > 0 {
+		until := time.Now().Add(time.Duration(l.RetainDays) * 24 * time.Hour)
+		in.ObjectLockRetainUntilDate = &until
+	}
+	if l.LegalHoldStatus != "" {
+		in.ObjectLockLegalHoldStatus = l.LegalHoldStatus
+	}
+}
+
+// GetObjectLockConfigurationAPI is the subset of *s3.Client
+// PreflightObjectLock needs.
+type GetObjectLockConfigurationAPI interface {
+	GetObjectLockConfiguration(ctx context.Context, in *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error)
+}
+
+// PreflightObjectLock warns, but never fails the build, if bucket doesn't
+// have Object Lock enabled: S3 silently ignores ObjectLockMode/
+// RetainUntilDate/LegalHoldStatus on a PutObject against a bucket that
+// was never created with Object Lock support, rather than rejecting the
+// request, so a user relying on those flags for tamper-evidence would
+// otherwise have no signal that they aren't doing anything.
+func PreflightObjectLock(ctx context.Context, client GetObjectLockConfigurationAPI, bucket string) {
+	out, err := client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: &bucket})
+	if err != nil {
+		logrus.Warnf("s3cache: could not verify Object Lock is enabled on bucket %s: %s", bucket, err)
+		return
+	}
+	if out.ObjectLockConfiguration == nil || out.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		logrus.Warnf("s3cache: bucket %s does not have Object Lock enabled; --cache-s3-object-lock-* flags will have no effect", bucket)
+	}
+}
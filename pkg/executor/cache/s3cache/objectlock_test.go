@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseObjectLock_DaysWithoutMode(t *testing.T) {
+	if _, err := ParseObjectLock(ObjectLockFlags{Days: 30}); err == nil {
+		t.Fatal("expected an error for --cache-s3-object-lock-days without --cache-s3-object-lock-mode")
+	}
+}
+
+func TestParseObjectLock_InvalidLegalHold(t *testing.T) {
+	if _, err := ParseObjectLock(ObjectLockFlags{LegalHold: "maybe"}); err == nil {
+		t.Fatal("expected an error for an invalid --cache-s3-object-lock-legal-hold value")
+	}
+}
+
+func TestObjectLock_Apply(t *testing.T) {
+	l, err := ParseObjectLock(ObjectLockFlags{Mode: "COMPLIANCE", Days: 7, LegalHold: "on"})
+	if err != nil {
+		t.Fatalf("ParseObjectLock: %s", err)
+	}
+
+	in := &s3.PutObjectInput{}
+	before := time.Now()
+	l.apply(in)
+
+	if in.ObjectLockMode != types.ObjectLockModeCompliance {
+		t.Errorf("ObjectLockMode = %q, want %q", in.ObjectLockMode, types.ObjectLockModeCompliance)
+	}
+	if in.ObjectLockLegalHoldStatus != types.ObjectLockLegalHoldStatusOn {
+		t.Errorf("ObjectLockLegalHoldStatus = %q, want %q", in.ObjectLockLegalHoldStatus, types.ObjectLockLegalHoldStatusOn)
+	}
+	if in.ObjectLockRetainUntilDate == nil || in.ObjectLockRetainUntilDate.Before(before.Add(6*24*time.Hour)) {
+		t.Errorf("ObjectLockRetainUntilDate = %v, want roughly 7 days from now", in.ObjectLockRetainUntilDate)
+	}
+}
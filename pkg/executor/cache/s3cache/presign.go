@@ -0,0 +1,140 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/executor/push/s3uploader"
+)
+
+// DefaultPresignTTL is how long a presigned PUT stays valid, set via
+// --cache-s3-presign-ttl, before whoever holds it has to ask the
+// controller for a fresh one.
+const DefaultPresignTTL = 15 * time.Minute
+
+// PresignAPI is the subset of *s3.PresignClient a privileged controller
+// needs to mint presigned PUT URLs on an executor's behalf.
+type PresignAPI interface {
+	PresignPutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+// PresignedPut is one Manifest entry: everything an unprivileged executor
+// needs to push a single cache object without ever holding an AWS
+// credential of its own.
+type PresignedPut struct {
+	URL           string
+	Method        string
+	SignedHeaders http.Header
+}
+
+// Manifest maps an S3 object key to the presigned PUT that writes it. A
+// controller that does hold S3 credentials builds one entry per cache key
+// a build is expected to produce and hands the whole Manifest to the
+// executor - over a file or an env var, kaniko doesn't care which - so the
+// executor can populate the cache without a credential of its own.
+type Manifest map[string]PresignedPut
+
+// NewManifest mints a presigned PUT, valid for ttl, for each of keys.
+// ttl <= 0 defaults to DefaultPresignTTL. encryption and objectLock are
+// baked into the PutObjectInput before it's presigned, so the resulting
+// PresignedPut.SignedHeaders carry the same x-amz-server-side-encryption*
+// and x-amz-object-lock* headers a direct client-based Push would have
+// set via Encryption.apply/ObjectLock.apply - pushPresigned only ever
+// replays SignedHeaders verbatim, so a protection that isn't baked in
+// here never reaches the object. Note that an Object Lock retention
+// window is fixed relative to when NewManifest mints the PUT, not when
+// the executor eventually uses it, since the signature can't be amended
+// later.
+func NewManifest(ctx context.Context, presigner PresignAPI, bucket string, keys []string, ttl time.Duration, encryption Encryption, objectLock ObjectLock) (Manifest, error) {
+	if ttl <= 0 {
+		ttl = DefaultPresignTTL
+	}
+	m := make(Manifest, len(keys))
+	for _, key := range keys {
+		in := &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		encryption.apply(in)
+		objectLock.apply(in)
+
+		req, err := presigner.PresignPutObject(ctx, in, func(o *s3.PresignOptions) { o.Expires = ttl })
+		if err != nil {
+			return nil, errors.Wrapf(err, "presigning PUT for %s", key)
+		}
+		m[key] = PresignedPut{URL: req.URL, Method: req.Method, SignedHeaders: req.SignedHeader}
+	}
+	return m, nil
+}
+
+// pushPresigned issues a raw HTTP PUT against entry's URL, bypassing the
+// SDK - and the credential it would otherwise need - entirely. It's the
+// executor-side half of Manifest: an unprivileged build only ever sees a
+// URL, never a credential. Despite bypassing the SDK, it still gets the
+// same SHA-256 integrity check putObject does: S3 validates a
+// x-amz-checksum-sha256 request header against the bytes it actually
+// received regardless of whether that header was part of the presigned
+// signature, so corruption in flight surfaces here as a failed PUT
+// instead of only being caught on the next cache hit that fails to
+// decompress.
+func pushPresigned(ctx context.Context, httpClient *http.Client, entry PresignedPut, in *s3.PutObjectInput, progress s3uploader.ProgressFunc) (*s3uploader.Output, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cache object body")
+	}
+	sum := sha256.Sum256(body)
+	b64Sum := base64.StdEncoding.EncodeToString(sum[:])
+
+	req, err := http.NewRequestWithContext(ctx, entry.Method, entry.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "building presigned PUT request")
+	}
+	for k, v := range entry.SignedHeaders {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-amz-checksum-sha256", b64Sum)
+	req.ContentLength = int64(len(body))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "presigned PUT")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.Errorf("presigned PUT to %s: unexpected status %s", aws.ToString(in.Key), resp.Status)
+	}
+	if echoed := resp.Header.Get("x-amz-checksum-sha256"); echoed != "" && echoed != b64Sum {
+		return nil, errors.Errorf("s3cache: checksum mismatch for %s: sent %s, S3 returned %s", aws.ToString(in.Key), b64Sum, echoed)
+	}
+
+	if progress != nil {
+		progress(int64(len(body)))
+	}
+	return &s3uploader.Output{ETag: resp.Header.Get("ETag")}, nil
+}
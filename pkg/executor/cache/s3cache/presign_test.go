@@ -0,0 +1,176 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakePresigner records the PutObjectInput NewManifest hands it, standing
+// in for the real *s3.PresignClient so tests can assert on what got baked
+// into the request before it was ever signed.
+type fakePresigner struct {
+	lastInput *s3.PutObjectInput
+}
+
+func (f *fakePresigner) PresignPutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	f.lastInput = in
+	return &v4.PresignedHTTPRequest{URL: "https://example.com/" + aws.ToString(in.Key), Method: http.MethodPut}, nil
+}
+
+func TestNewManifest_BakesInEncryptionAndObjectLock(t *testing.T) {
+	presigner := &fakePresigner{}
+
+	encryption := Encryption{ServerSideEncryption: types.ServerSideEncryptionAwsKms, KMSKeyID: "key-id"}
+	objectLock := ObjectLock{Mode: types.ObjectLockModeCompliance, RetainDays: 7}
+
+	if _, err := NewManifest(context.Background(), presigner, "bucket", []string{"k"}, time.Minute, encryption, objectLock); err != nil {
+		t.Fatalf("NewManifest: %s", err)
+	}
+
+	in := presigner.lastInput
+	if in == nil {
+		t.Fatal("expected PresignPutObject to be called")
+	}
+	if in.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("ServerSideEncryption = %q, want %q", in.ServerSideEncryption, types.ServerSideEncryptionAwsKms)
+	}
+	if aws.ToString(in.SSEKMSKeyId) != "key-id" {
+		t.Errorf("SSEKMSKeyId = %q, want %q", aws.ToString(in.SSEKMSKeyId), "key-id")
+	}
+	if in.ObjectLockMode != types.ObjectLockModeCompliance {
+		t.Errorf("ObjectLockMode = %q, want %q", in.ObjectLockMode, types.ObjectLockModeCompliance)
+	}
+	if in.ObjectLockRetainUntilDate == nil {
+		t.Error("expected ObjectLockRetainUntilDate to be set")
+	}
+}
+
+func TestPush_PresignedManifest_BypassesClient(t *testing.T) {
+	var receivedBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("method = %s, want PUT", r.Method)
+		}
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", `"presigned-etag"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{
+		PresignedManifest: Manifest{
+			"k": PresignedPut{URL: srv.URL, Method: http.MethodPut},
+		},
+	})
+
+	size := int64(10)
+	body := make([]byte, size)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(body), ContentLength: &size}
+	out, err := p.Push(context.Background(), in, nil)
+	if err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if out.ETag != `"presigned-etag"` {
+		t.Errorf("ETag = %q", out.ETag)
+	}
+	if string(receivedBody) != string(body) {
+		t.Errorf("server received %q, want %q", receivedBody, body)
+	}
+	if fake.puts != 0 || fake.creates != 0 {
+		t.Errorf("expected the SDK client to be bypassed entirely, got puts=%d creates=%d", fake.puts, fake.creates)
+	}
+}
+
+func TestPush_PresignedManifest_SendsChecksumHeader(t *testing.T) {
+	var gotChecksum string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotChecksum = r.Header.Get("x-amz-checksum-sha256")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{
+		PresignedManifest: Manifest{
+			"k": PresignedPut{URL: srv.URL, Method: http.MethodPut},
+		},
+	})
+
+	size := int64(10)
+	body := make([]byte, size)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(body), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if gotChecksum == "" {
+		t.Fatal("expected a x-amz-checksum-sha256 header on the presigned PUT")
+	}
+}
+
+// TestPush_PresignedManifest_DetectsChecksumMismatch simulates a server
+// that echoes back a x-amz-checksum-sha256 that never matches what was
+// sent, as if the object were corrupted between kaniko and S3.
+func TestPush_PresignedManifest_DetectsChecksumMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amz-checksum-sha256", "bm90LXRoZS1yaWdodC1jaGVja3N1bQ==")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{
+		PresignedManifest: Manifest{
+			"k": PresignedPut{URL: srv.URL, Method: http.MethodPut},
+		},
+	})
+
+	size := int64(10)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(make([]byte, size)), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
+
+func TestPush_NoManifestEntry_FallsBackToClient(t *testing.T) {
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{
+		MultipartThreshold: 1024,
+		PresignedManifest:  Manifest{"other-key": PresignedPut{}},
+	})
+
+	size := int64(10)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(make([]byte, size)), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if fake.puts != 1 {
+		t.Errorf("expected the SDK fallback to PutObject, got puts=%d", fake.puts)
+	}
+}
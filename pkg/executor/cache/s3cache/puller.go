@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// GetObjectAPI is the subset of *s3.Client a Puller needs.
+type GetObjectAPI interface {
+	GetObject(ctx context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// PullOptions carries the cross-account knobs set by --cache-s3-request-
+// payer and --cache-s3-expected-bucket-owner, applied to every GetObject
+// a Puller issues.
+type PullOptions struct {
+	RequestPayer        types.RequestPayer
+	ExpectedBucketOwner *string
+}
+
+// Puller fetches a single cache entry from S3. Because kaniko's cache is
+// content-addressed, every entry it fetches is supposed to be the exact
+// bytes behind a known digest - Pull treats anything else as a miss
+// rather than a hit, so a silently-corrupted or tampered cache object
+// can't poison the build that consumes it.
+type Puller struct {
+	client GetObjectAPI
+	opts   PullOptions
+}
+
+// NewPuller returns a Puller that issues requests through client.
+func NewPuller(client GetObjectAPI, opts PullOptions) *Puller {
+	return &Puller{client: client, opts: opts}
+}
+
+// Pull fetches bucket/key and verifies it against want, the descriptor
+// digest recorded for this layer/manifest. When S3 echoes back a
+// whole-object SHA-256 (ChecksumMode enabled, and the object wasn't
+// written as a multipart upload - S3 marks those composite checksums
+// with a "-N" suffix, which isn't a digest of the object's bytes), Pull
+// checks that directly. Otherwise it falls back to hashing the body
+// itself rather than skipping verification.
+func (p *Puller) Pull(ctx context.Context, bucket, key string, want v1.Hash) (io.ReadCloser, error) {
+	out, err := p.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:              &bucket,
+		Key:                 &key,
+		ChecksumMode:        types.ChecksumModeEnabled,
+		RequestPayer:        p.opts.RequestPayer,
+		ExpectedBucketOwner: p.opts.ExpectedBucketOwner,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "GetObject")
+	}
+
+	if want.Algorithm != "sha256" {
+		return out.Body, nil
+	}
+
+	if echoed := aws.ToString(out.ChecksumSHA256); echoed != "" && !strings.Contains(echoed, "-") {
+		raw, err := base64.StdEncoding.DecodeString(echoed)
+		if err != nil {
+			out.Body.Close()
+			return nil, errors.Wrap(err, "decoding ChecksumSHA256")
+		}
+		if hex.EncodeToString(raw) != want.Hex {
+			out.Body.Close()
+			return nil, errors.Errorf("s3cache: %s/%s checksum mismatch: S3 returned %x, manifest wants %s", bucket, key, raw, want.Hex)
+		}
+		return out.Body, nil
+	}
+
+	return p.verifyBody(out.Body, bucket, key, want)
+}
+
+// verifyBody hashes body in full and compares it against want, returning
+// a fresh reader over the same bytes so the caller can still read the
+// object after verification consumed the original stream.
+func (p *Puller) verifyBody(body io.ReadCloser, bucket, key string, want v1.Hash) (io.ReadCloser, error) {
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cache object body")
+	}
+	sum := sha256.Sum256(b)
+	if got := hex.EncodeToString(sum[:]); got != want.Hex {
+		return nil, errors.Errorf("s3cache: %s/%s checksum mismatch: body hashes to %s, manifest wants %s", bucket, key, got, want.Hex)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+type fakeGetObjectAPI struct {
+	body           []byte
+	checksumSHA256 string
+}
+
+func (f *fakeGetObjectAPI) GetObject(_ context.Context, _ *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out := &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.body))}
+	if f.checksumSHA256 != "" {
+		out.ChecksumSHA256 = aws.String(f.checksumSHA256)
+	}
+	return out, nil
+}
+
+func TestPuller_Pull_VerifiesEchoedChecksum(t *testing.T) {
+	body := []byte("layer bytes")
+	sum := sha256.Sum256(body)
+	fake := &fakeGetObjectAPI{body: body, checksumSHA256: base64.StdEncoding.EncodeToString(sum[:])}
+	p := NewPuller(fake, PullOptions{})
+
+	got, err := p.Pull(context.Background(), "bucket", "key", v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatalf("Pull: %s", err)
+	}
+	read, err := io.ReadAll(got)
+	if err != nil {
+		t.Fatalf("reading pulled body: %s", err)
+	}
+	if string(read) != string(body) {
+		t.Errorf("body = %q, want %q", read, body)
+	}
+}
+
+func TestPuller_Pull_RejectsChecksumMismatch(t *testing.T) {
+	body := []byte("layer bytes")
+	fake := &fakeGetObjectAPI{body: body, checksumSHA256: base64.StdEncoding.EncodeToString([]byte("not the right hash!!!!!"))}
+	p := NewPuller(fake, PullOptions{})
+
+	wantSum := sha256.Sum256(body)
+	if _, err := p.Pull(context.Background(), "bucket", "key", v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(wantSum[:])}); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
+
+func TestPuller_Pull_FallsBackToHashingBody(t *testing.T) {
+	body := []byte("layer bytes")
+	sum := sha256.Sum256(body)
+
+	// No ChecksumSHA256 echoed at all - Pull must still verify by hashing
+	// the body itself rather than trusting it unconditionally.
+	fake := &fakeGetObjectAPI{body: body}
+	p := NewPuller(fake, PullOptions{})
+	if _, err := p.Pull(context.Background(), "bucket", "key", v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("Pull: %s", err)
+	}
+
+	bad := sha256.Sum256([]byte("wrong bytes"))
+	fake = &fakeGetObjectAPI{body: body}
+	if _, err := p.Pull(context.Background(), "bucket", "key", v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(bad[:])}); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3cache pushes cached layers/exported tarballs to an S3-backed
+// cache. Below --cache-s3-multipart-threshold it's a single PutObject,
+// same as before; at or above it, Pusher hands off to
+// pkg/executor/push/s3uploader for a concurrent multipart upload, so a
+// large cached layer doesn't fail outright on a flaky network or the 5GB
+// single-PUT limit.
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/executor/push/s3uploader"
+)
+
+// DefaultPartSize is the size of each part a multipart cache push
+// buffers and uploads, set via --cache-s3-part-size.
+const DefaultPartSize = 16 * 1024 * 1024 // 16MiB
+
+// DefaultConcurrency is the number of parts uploaded in parallel.
+const DefaultConcurrency = 4
+
+// DefaultMultipartThreshold is the object size, set via
+// --cache-s3-multipart-threshold, at or above which Pusher switches from
+// a single PutObject to a multipart upload. It defaults to matching
+// DefaultPartSize, the same rule of thumb s3manager's own Uploader uses.
+const DefaultMultipartThreshold = DefaultPartSize
+
+// Options configures a Pusher.
+type Options struct {
+	// MultipartThreshold is the object size, in bytes, at or above which
+	// Push uses a multipart upload instead of a single PutObject.
+	// Defaults to DefaultMultipartThreshold. Ignored if the body's length
+	// isn't known up front (PutObjectInput.ContentLength is nil); Push
+	// then defers to s3uploader's own probe-based split.
+	MultipartThreshold int64
+	// PartSize is forwarded to s3uploader.Options.PartSize. Defaults to
+	// DefaultPartSize.
+	PartSize int64
+	// Concurrency is forwarded to s3uploader.Options.Concurrency.
+	// Defaults to DefaultConcurrency.
+	Concurrency int
+	// Encryption configures the at-rest encryption applied to every
+	// object this Pusher writes.
+	Encryption Encryption
+	// PresignedManifest, when set, is consulted before every push: a key
+	// present in it is written with a raw HTTP PUT against its presigned
+	// URL instead of through client, so an executor holding only a
+	// Manifest (and no S3 credential) can still populate the cache. Keys
+	// it doesn't cover fall back to the normal client-based push.
+	PresignedManifest Manifest
+	// HTTPClient issues the presigned PUTs PresignedManifest entries
+	// describe. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// ObjectLock configures WORM protection for every object this Pusher
+	// writes.
+	ObjectLock ObjectLock
+}
+
+// Encryption carries the --cache-s3-sse family of flags.
+type Encryption struct {
+	// ServerSideEncryption is --cache-s3-sse, e.g. "aws:kms", "AES256", or
+	// "aws:kms:dsse".
+	ServerSideEncryption types.ServerSideEncryption
+	// KMSKeyID is --cache-s3-kms-key-id. Only meaningful when
+	// ServerSideEncryption selects a KMS mode.
+	KMSKeyID string
+	// KMSEncryptionContext is --cache-s3-kms-encryption-context, the
+	// base64-encoded JSON KMS encryption context.
+	KMSEncryptionContext string
+	// BucketKeyEnabled is --cache-s3-bucket-key: use an S3 Bucket Key to
+	// reduce KMS request traffic for SSE-KMS objects.
+	BucketKeyEnabled bool
+}
+
+// apply sets e's fields onto in, leaving anything e didn't configure
+// untouched.
+func (e Encryption) apply(in *s3.PutObjectInput) {
+	if e.ServerSideEncryption != "" {
+		in.ServerSideEncryption = e.ServerSideEncryption
+	}
+	if e.KMSKeyID != "" {
+		in.SSEKMSKeyId = &e.KMSKeyID
+	}
+	if e.KMSEncryptionContext != "" {
+		in.SSEKMSEncryptionContext = &e.KMSEncryptionContext
+	}
+	if e.BucketKeyEnabled {
+		in.BucketKeyEnabled = &e.BucketKeyEnabled
+	}
+}
+
+func (o Options) withDefaults() Options {
+	if o.MultipartThreshold <= 0 {
+		o.MultipartThreshold = DefaultMultipartThreshold
+	}
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+	return o
+}
+
+// Pusher pushes a single cache entry to S3.
+type Pusher struct {
+	client s3uploader.API
+	opts   Options
+}
+
+// NewPusher returns a Pusher that issues requests through client.
+func NewPusher(client s3uploader.API, opts Options) *Pusher {
+	return &Pusher{client: client, opts: opts.withDefaults()}
+}
+
+// Push sends in.Body to S3. Below opts.MultipartThreshold (when
+// in.ContentLength is known) it issues a single PutObject, matching
+// kaniko's pre-existing cache push path; otherwise it multipart-uploads
+// via s3uploader, with a SHA256 checksum computed per part so corruption
+// in flight is caught the same way a cache-miss due to a bad digest would
+// be, rather than only being caught on the next cache hit that fails to
+// decompress.
+func (p *Pusher) Push(ctx context.Context, in *s3.PutObjectInput, progress s3uploader.ProgressFunc) (*s3uploader.Output, error) {
+	if entry, ok := p.opts.PresignedManifest[aws.ToString(in.Key)]; ok {
+		return pushPresigned(ctx, p.opts.HTTPClient, entry, in, progress)
+	}
+
+	p.opts.Encryption.apply(in)
+	p.opts.ObjectLock.apply(in)
+
+	var (
+		out *s3uploader.Output
+		err error
+	)
+	if in.ContentLength != nil && *in.ContentLength < p.opts.MultipartThreshold {
+		out, err = p.putObject(ctx, in, progress)
+	} else {
+		uploader := s3uploader.NewUploader(p.client, s3uploader.Options{
+			PartSize:          p.opts.PartSize,
+			Concurrency:       p.opts.Concurrency,
+			ChecksumAlgorithm: s3uploader.ChecksumSHA256,
+		})
+		out, err = uploader.Upload(ctx, in, progress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if out.ServerSideEncryption != "" {
+		logrus.Infof("cache object %s encrypted with %s", *in.Key, out.ServerSideEncryption)
+	}
+	if out.SSEKMSKeyID != "" {
+		logrus.Debugf("cache object %s sealed with KMS key %s", *in.Key, out.SSEKMSKeyID)
+	}
+	return out, nil
+}
+
+// putObject is the fallback path for objects below the multipart
+// threshold: the same single PutObject kaniko's S3 cache pusher always
+// used, plus a locally-computed SHA-256 checksum so a cache entry
+// corrupted in flight is caught here instead of surfacing later as a
+// cache hit that fails to decompress.
+func (p *Pusher) putObject(ctx context.Context, in *s3.PutObjectInput, progress s3uploader.ProgressFunc) (*s3uploader.Output, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cache object body")
+	}
+	sum := sha256.Sum256(body)
+	b64Sum := base64.StdEncoding.EncodeToString(sum[:])
+
+	put := *in
+	put.Body = bytes.NewReader(body)
+	put.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	put.ChecksumSHA256 = &b64Sum
+
+	out, err := p.client.PutObject(ctx, &put)
+	if err != nil {
+		return nil, err
+	}
+	if echoed := aws.ToString(out.ChecksumSHA256); echoed != "" && echoed != b64Sum {
+		return nil, errors.Errorf("s3cache: checksum mismatch for %s: sent %s, S3 returned %s", aws.ToString(in.Key), b64Sum, echoed)
+	}
+	if progress != nil {
+		progress(int64(len(body)))
+	}
+	etag := ""
+	if out.ETag != nil {
+		etag = *out.ETag
+	}
+	return &s3uploader.Output{
+		ETag:                 etag,
+		ServerSideEncryption: out.ServerSideEncryption,
+		SSEKMSKeyID:          aws.ToString(out.SSEKMSKeyId),
+	}, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type fakeAPI struct {
+	puts    int
+	creates int
+}
+
+func (f *fakeAPI) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.puts++
+	return &s3.PutObjectOutput{ETag: aws.String("etag")}, nil
+}
+
+func (f *fakeAPI) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.creates++
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+}
+
+func (f *fakeAPI) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return &s3.UploadPartOutput{ETag: aws.String("part-etag")}, nil
+}
+
+func (f *fakeAPI) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String("final-etag")}, nil
+}
+
+func (f *fakeAPI) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestPush_BelowThreshold_UsesPutObject(t *testing.T) {
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{MultipartThreshold: 1024})
+
+	size := int64(10)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(make([]byte, size)), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if fake.puts != 1 || fake.creates != 0 {
+		t.Errorf("expected a single PutObject call, got puts=%d creates=%d", fake.puts, fake.creates)
+	}
+}
+
+// corruptingAPI echoes back a ChecksumSHA256 that never matches what was
+// sent, simulating corruption between kaniko and S3.
+type corruptingAPI struct {
+	fakeAPI
+}
+
+func (f *corruptingAPI) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	out, err := f.fakeAPI.PutObject(ctx, in, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	out.ChecksumSHA256 = aws.String("bm90LXRoZS1yaWdodC1jaGVja3N1bQ==")
+	return out, nil
+}
+
+func TestPush_BelowThreshold_DetectsChecksumMismatch(t *testing.T) {
+	fake := &corruptingAPI{}
+	p := NewPusher(fake, Options{MultipartThreshold: 1024})
+
+	size := int64(10)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(make([]byte, size)), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
+
+func TestEncryption_Apply(t *testing.T) {
+	e := Encryption{
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+		KMSKeyID:             "arn:aws:kms:us-east-1:111122223333:key/test",
+		BucketKeyEnabled:     true,
+	}
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}
+	e.apply(in)
+
+	if in.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("ServerSideEncryption = %q, want %q", in.ServerSideEncryption, types.ServerSideEncryptionAwsKms)
+	}
+	if aws.ToString(in.SSEKMSKeyId) != e.KMSKeyID {
+		t.Errorf("SSEKMSKeyId = %q, want %q", aws.ToString(in.SSEKMSKeyId), e.KMSKeyID)
+	}
+	if !aws.ToBool(in.BucketKeyEnabled) {
+		t.Errorf("BucketKeyEnabled not set")
+	}
+}
+
+func TestPush_AtOrAboveThreshold_UsesMultipart(t *testing.T) {
+	fake := &fakeAPI{}
+	p := NewPusher(fake, Options{MultipartThreshold: 8, PartSize: 8, Concurrency: 2})
+
+	size := int64(64)
+	in := &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: bytes.NewReader(make([]byte, size)), ContentLength: &size}
+	if _, err := p.Push(context.Background(), in, nil); err != nil {
+		t.Fatalf("Push: %s", err)
+	}
+	if fake.puts != 0 || fake.creates != 1 {
+		t.Errorf("expected a multipart upload, got puts=%d creates=%d", fake.puts, fake.creates)
+	}
+}
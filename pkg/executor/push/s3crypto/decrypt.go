@@ -0,0 +1,203 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// cekAlgCBCLegacy is the content algorithm the V1 S3 Encryption Client
+// wrote; ReadProfileV2AndLegacy accepts it in addition to cekAlgGCM.
+const cekAlgCBCLegacy = "AES/CBC/PKCS5Padding"
+
+// Decryptor reverses Encryptor, given the envelope a GetObject call
+// returned as object metadata alongside the (still-encrypted) body.
+type Decryptor struct {
+	kms  KMSAPI
+	opts Options
+}
+
+// NewDecryptor returns a Decryptor honoring opts.ReadProfile (defaulting
+// to ReadProfileV2).
+func NewDecryptor(kmsClient KMSAPI, opts Options) *Decryptor {
+	return &Decryptor{kms: kmsClient, opts: opts}
+}
+
+// Decrypt recovers the plaintext body, given metadata as returned in a
+// GetObjectOutput's Metadata field and the matching (ciphertext) body.
+// It returns the body unchanged if metadata carries no envelope at all,
+// so callers can use it unconditionally on objects that may or may not
+// be encrypted.
+func (d *Decryptor) Decrypt(ctx context.Context, metadata map[string]string, body []byte) ([]byte, error) {
+	cekAlg, ok := metadata[MetaCEKAlg]
+	if !ok {
+		return body, nil
+	}
+
+	switch cekAlg {
+	case cekAlgGCM:
+		return d.decryptGCM(ctx, metadata, body)
+	case cekAlgCBCLegacy:
+		if d.opts.readProfile() != ReadProfileV2AndLegacy {
+			return nil, errors.Errorf("s3crypto: refusing to read legacy %s envelope; ReadProfile is %s, not %s", cekAlg, d.opts.readProfile(), ReadProfileV2AndLegacy)
+		}
+		return d.decryptLegacyCBC(metadata, body)
+	default:
+		return nil, fmt.Errorf("s3crypto: unsupported %s %q", MetaCEKAlg, cekAlg)
+	}
+}
+
+func (d *Decryptor) unwrapCEK(ctx context.Context, metadata map[string]string) ([]byte, error) {
+	wrapAlg, ok := metadata[MetaWrapAlg]
+	if !ok {
+		return nil, errors.Errorf("s3crypto: object is missing %s", MetaWrapAlg)
+	}
+	wrapped, err := base64Decode(metadata[MetaCEK])
+	if err != nil {
+		return nil, err
+	}
+
+	switch wrapAlg {
+	case wrapAlgKMSContext:
+		desc, err := unmarshalMatDesc(metadata[MetaMatDesc])
+		if err != nil {
+			return nil, err
+		}
+		return unwrapKMS(ctx, d.kms, wrapped, desc)
+	case wrapAlgAESGCM:
+		return unwrapLocal(d.opts.SymmetricKey, wrapped)
+	default:
+		return nil, fmt.Errorf("s3crypto: unsupported %s %q", MetaWrapAlg, wrapAlg)
+	}
+}
+
+// decryptGCM reverses frameEncryptReader: it walks the length-prefixed
+// frames Encrypt wrote, each sealed under a nonce derived from the
+// envelope's base IV and the frame's position in the stream. Finality is
+// never trusted from the frame itself - the AAD byte a frame is opened
+// with is derived from whether any bytes remain after it, the same way
+// Encrypt derived it from whether the source had more to give - so an
+// object truncated after a non-final frame fails to authenticate instead
+// of decrypting short.
+func (d *Decryptor) decryptGCM(ctx context.Context, metadata map[string]string, ciphertext []byte) ([]byte, error) {
+	cek, err := d.unwrapCEK(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	baseIV, err := base64Decode(metadata[MetaIV])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext bytes.Buffer
+	var counter uint32
+	buf := ciphertext
+	for {
+		if len(buf) < streamLenPrefix {
+			return nil, errors.New("s3crypto: truncated frame length prefix")
+		}
+		frameLen := binary.BigEndian.Uint32(buf[:streamLenPrefix])
+		buf = buf[streamLenPrefix:]
+		if uint64(frameLen) > uint64(len(buf)) {
+			return nil, errors.New("s3crypto: truncated frame body")
+		}
+		frame := buf[:frameLen]
+		buf = buf[frameLen:]
+
+		nonce := make([]byte, len(baseIV)+streamLenPrefix)
+		copy(nonce, baseIV)
+		binary.BigEndian.PutUint32(nonce[len(baseIV):], counter)
+		counter++
+
+		final := len(buf) == 0
+		aad := []byte{0}
+		if final {
+			aad[0] = 1
+		}
+
+		chunk, err := gcm.Open(nil, nonce, frame, aad)
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypting object body")
+		}
+		plaintext.Write(chunk)
+
+		if final {
+			return plaintext.Bytes(), nil
+		}
+	}
+}
+
+// decryptLegacyCBC decrypts the format the V1 (pre-GCM) S3 Encryption
+// Client wrote. It exists purely so a v2_and_legacy reader doesn't choke
+// on objects it didn't write itself; Encrypt never produces this format.
+func (d *Decryptor) decryptLegacyCBC(metadata map[string]string, ciphertext []byte) ([]byte, error) {
+	wrapAlg, ok := metadata[MetaWrapAlg]
+	if !ok || wrapAlg != wrapAlgAESGCM {
+		return nil, errors.Errorf("s3crypto: legacy envelope requires a local %s-wrapped key", wrapAlgAESGCM)
+	}
+	wrapped, err := base64Decode(metadata[MetaCEK])
+	if err != nil {
+		return nil, err
+	}
+	cek, err := unwrapLocal(d.opts.SymmetricKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64Decode(metadata[MetaIV])
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, errors.Wrap(err, "constructing AES cipher")
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("s3crypto: legacy ciphertext is not a multiple of the AES block size")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpadPKCS7(plaintext)
+}
+
+func unpadPKCS7(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("s3crypto: empty plaintext")
+	}
+	padLen := int(b[len(b)-1])
+	if padLen == 0 || padLen > aes.BlockSize || padLen > len(b) {
+		return nil, errors.New("s3crypto: invalid PKCS7 padding")
+	}
+	for _, p := range b[len(b)-padLen:] {
+		if int(p) != padLen {
+			return nil, errors.New("s3crypto: invalid PKCS7 padding")
+		}
+	}
+	return b[:len(b)-padLen], nil
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3crypto
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// streamChunkSize is the amount of plaintext sealed into a single GCM
+// frame. Keeping it well below the multipart part size means Encrypt
+// never has to hold more than one chunk of the object in memory at once,
+// regardless of how large the body behind in.Body is.
+const streamChunkSize = 1 << 20 // 1 MiB
+
+// streamLenPrefix is the width of the big-endian length prefix in front
+// of each frame's ciphertext.
+const streamLenPrefix = 4
+
+// Encryptor encrypts PutObjectInput bodies under Options before they are
+// handed to s3uploader.
+type Encryptor struct {
+	kms  KMSAPI
+	opts Options
+}
+
+// NewEncryptor returns an Encryptor. kmsClient may be nil if opts only
+// ever selects ModeSymmetric.
+func NewEncryptor(kmsClient KMSAPI, opts Options) *Encryptor {
+	return &Encryptor{kms: kmsClient, opts: opts}
+}
+
+// Encrypt returns a copy of in with Body wrapped in a streaming AES-GCM
+// cipher and the envelope recorded in Metadata. If opts selected
+// ModeNone, in is returned unmodified. The body is never buffered in
+// full: frameEncryptReader seals it one streamChunkSize frame at a time,
+// so a multi-GB tarball costs streamChunkSize of memory to push, not its
+// own size.
+func (e *Encryptor) Encrypt(ctx context.Context, in *s3.PutObjectInput) (*s3.PutObjectInput, error) {
+	mode := e.opts.mode()
+	if mode == ModeNone {
+		return in, nil
+	}
+
+	cek, err := generateBytes(cekSizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	// The frame nonce is baseIV (ivSizeBytes-4 random bytes) with a
+	// 4-byte big-endian frame counter appended, so every frame in the
+	// object gets a unique nonce without needing a fresh random value
+	// (and without risking reuse across streamChunkSize-sized frames).
+	baseIV, err := generateBytes(ivSizeBytes - streamLenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := matDesc{}
+	var wrapAlg, wrappedKeyB64 string
+	switch mode {
+	case ModeKMS:
+		desc["kms_cmk_id"] = e.opts.KMSKeyID
+		// KMS mints the CEK itself (rather than us generating one
+		// locally and asking KMS to encrypt it), so we use its
+		// plaintext data key as the CEK.
+		generated, wrapped, kerr := wrapKMS(ctx, e.kms, e.opts.KMSKeyID, desc)
+		if kerr != nil {
+			return nil, kerr
+		}
+		cek = generated
+		wrapAlg = wrapAlgKMSContext
+		wrappedKeyB64 = base64Encode(wrapped)
+	case ModeSymmetric:
+		wrapped, werr := wrapLocal(e.opts.SymmetricKey, cek)
+		if werr != nil {
+			return nil, werr
+		}
+		wrapAlg = wrapAlgAESGCM
+		wrappedKeyB64 = base64Encode(wrapped)
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+
+	descJSON, err := desc.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	out := *in
+	out.Body = newFrameEncryptReader(in.Body, gcm, baseIV)
+	out.Metadata = cloneMetadata(in.Metadata)
+	out.Metadata[MetaCEK] = wrappedKeyB64
+	out.Metadata[MetaIV] = base64Encode(baseIV)
+	out.Metadata[MetaCEKAlg] = cekAlgGCM
+	out.Metadata[MetaWrapAlg] = wrapAlg
+	out.Metadata[MetaMatDesc] = descJSON
+	out.Metadata[MetaTagLen] = tagLenBits
+
+	if in.ContentLength != nil {
+		out.Metadata[MetaUnencryptedContentLength] = strconv.FormatInt(*in.ContentLength, 10)
+		encLen := encryptedContentLength(*in.ContentLength, gcm.Overhead())
+		out.ContentLength = &encLen
+	} else {
+		// Without a known plaintext length we can't predict the framed
+		// ciphertext length either; let the uploader figure it out (it
+		// already has to, for an unsized body).
+		out.ContentLength = nil
+	}
+
+	return &out, nil
+}
+
+// encryptedContentLength returns the size of the framed ciphertext that
+// newFrameEncryptReader produces for a plaintextLen-byte body, given
+// gcm's per-frame authentication tag overhead.
+func encryptedContentLength(plaintextLen int64, tagOverhead int) int64 {
+	frameOverhead := int64(streamLenPrefix + tagOverhead)
+	fullFrames := plaintextLen / streamChunkSize
+	remainder := plaintextLen % streamChunkSize
+	// fullFrames full-size frames, plus one more frame carrying whatever
+	// is left over (possibly empty, e.g. when plaintextLen is an exact
+	// multiple of streamChunkSize) to mark the end of the stream.
+	return fullFrames*(streamChunkSize+frameOverhead) + remainder + frameOverhead
+}
+
+func cloneMetadata(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m)+6)
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// frameEncryptReader wraps a plaintext io.Reader, sealing it into a
+// stream of independently-authenticated AES-GCM frames: each frame is a
+// 4-byte big-endian length prefix followed by up to streamChunkSize
+// bytes of plaintext sealed under a nonce derived from baseIV and the
+// frame's index. The final frame's AAD is tagged "final" so that
+// truncating the object - dropping its last frame(s) - is detected as an
+// authentication failure on read, rather than silently yielding
+// truncated plaintext.
+type frameEncryptReader struct {
+	src     io.Reader
+	seal    frameSealer
+	baseIV  []byte
+	counter uint32
+	plain   []byte
+	out     []byte
+	outOff  int
+	done    bool
+}
+
+// frameSealer is the subset of cipher.AEAD frameEncryptReader needs; kept
+// as its own type so it's mockable in tests without pulling in crypto/cipher.
+type frameSealer interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Overhead() int
+}
+
+func newFrameEncryptReader(src io.Reader, gcm frameSealer, baseIV []byte) *frameEncryptReader {
+	if src == nil {
+		src = new(nopReader)
+	}
+	return &frameEncryptReader{
+		src:    src,
+		seal:   gcm,
+		baseIV: append([]byte(nil), baseIV...),
+		plain:  make([]byte, streamChunkSize),
+	}
+}
+
+type nopReader struct{}
+
+func (*nopReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (r *frameEncryptReader) Read(p []byte) (int, error) {
+	for r.outOff >= len(r.out) {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fillNextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out[r.outOff:])
+	r.outOff += n
+	return n, nil
+}
+
+// fillNextFrame reads and seals the next frame of ciphertext into r.out.
+// A frame is "final" - and frameEncryptReader stops after it - whenever
+// reading plaintext for it comes up short of a full streamChunkSize,
+// including a deliberate zero-length final frame when the plaintext
+// ends on a streamChunkSize boundary: the receiving end needs an
+// explicit final marker it can't be tricked into skipping.
+func (r *frameEncryptReader) fillNextFrame() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return errors.Wrap(err, "reading plaintext for encryption")
+	}
+	final := err == io.ErrUnexpectedEOF || err == io.EOF
+
+	nonce := make([]byte, len(r.baseIV)+streamLenPrefix)
+	copy(nonce, r.baseIV)
+	binary.BigEndian.PutUint32(nonce[len(r.baseIV):], r.counter)
+	r.counter++
+
+	aad := []byte{0}
+	if final {
+		aad[0] = 1
+	}
+	ciphertext := r.seal.Seal(nil, nonce, r.plain[:n], aad)
+
+	frame := make([]byte, streamLenPrefix+len(ciphertext))
+	binary.BigEndian.PutUint32(frame, uint32(len(ciphertext)))
+	copy(frame[streamLenPrefix:], ciphertext)
+
+	r.out = frame
+	r.outOff = 0
+	r.done = final
+	return nil
+}
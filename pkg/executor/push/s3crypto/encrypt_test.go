@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3crypto
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func int64Ptr(v int64) *int64 { return &v }
+
+func symmetricOpts(t *testing.T) Options {
+	t.Helper()
+	key, err := generateBytes(cekSizeBytes)
+	if err != nil {
+		t.Fatalf("generating symmetric key: %v", err)
+	}
+	return Options{SymmetricKey: key}
+}
+
+// readingReader caps how many bytes frameEncryptReader can pull in a
+// single Read, exercising the same partial-read path a real network body
+// would.
+type readingReader struct {
+	r     io.Reader
+	limit int
+}
+
+func (r *readingReader) Read(p []byte) (int, error) {
+	if len(p) > r.limit {
+		p = p[:r.limit]
+	}
+	return r.r.Read(p)
+}
+
+func TestEncryptDecrypt_Roundtrip(t *testing.T) {
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"exact chunk boundary", streamChunkSize},
+		{"multiple chunks", streamChunkSize*2 + 12345},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			plaintext := bytes.Repeat([]byte("kaniko"), tc.size/6+1)[:tc.size]
+
+			enc := NewEncryptor(nil, symmetricOpts(t))
+			in := &s3.PutObjectInput{
+				Body:          &readingReader{r: bytes.NewReader(plaintext), limit: 4096},
+				ContentLength: int64Ptr(int64(tc.size)),
+			}
+
+			out, err := enc.Encrypt(context.Background(), in)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+
+			ciphertext, err := io.ReadAll(out.Body)
+			if err != nil {
+				t.Fatalf("reading encrypted body: %v", err)
+			}
+			if out.ContentLength == nil {
+				t.Fatal("expected ContentLength to be set when input ContentLength was known")
+			}
+			if int64(len(ciphertext)) != *out.ContentLength {
+				t.Fatalf("ContentLength %d doesn't match actual ciphertext length %d", *out.ContentLength, len(ciphertext))
+			}
+
+			dec := NewDecryptor(nil, Options{SymmetricKey: enc.opts.SymmetricKey})
+			got, err := dec.Decrypt(context.Background(), out.Metadata, ciphertext)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("roundtripped plaintext does not match original (got %d bytes, want %d)", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestDecrypt_DetectsTruncation(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("x"), streamChunkSize+1000)
+
+	enc := NewEncryptor(nil, symmetricOpts(t))
+	in := &s3.PutObjectInput{
+		Body:          bytes.NewReader(plaintext),
+		ContentLength: int64Ptr(int64(len(plaintext))),
+	}
+	out, err := enc.Encrypt(context.Background(), in)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	ciphertext, err := io.ReadAll(out.Body)
+	if err != nil {
+		t.Fatalf("reading encrypted body: %v", err)
+	}
+
+	// Drop the final frame, simulating an object truncated in storage.
+	// The remaining first frame is non-final (its AAD said so at seal
+	// time), so a decoder that just stops when it runs out of bytes
+	// would otherwise return a truncated-but-valid-looking plaintext.
+	truncated := ciphertext[:streamLenPrefix+streamChunkSize+16]
+
+	dec := NewDecryptor(nil, Options{SymmetricKey: enc.opts.SymmetricKey})
+	if _, err := dec.Decrypt(context.Background(), out.Metadata, truncated); err == nil {
+		t.Fatal("expected Decrypt to fail on a truncated object, got nil error")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3crypto
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/pkg/errors"
+)
+
+// matDesc is the material description carried as x-amz-matdesc: JSON
+// bound into the KMS encryption context, so a wrapped CEK only decrypts
+// when the same description is presented again. For KMS mode it names the
+// KMS key only; nothing in it identifies the object.
+type matDesc map[string]string
+
+func (m matDesc) marshal() (string, error) {
+	if m == nil {
+		m = matDesc{}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling material description")
+	}
+	return string(b), nil
+}
+
+func unmarshalMatDesc(s string) (matDesc, error) {
+	var m matDesc
+	if err := json.Unmarshal([]byte(s), &m); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling material description")
+	}
+	return m, nil
+}
+
+// KMSAPI is the subset of *kms.Client the KMS wrap mode needs.
+type KMSAPI interface {
+	GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, in *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// wrapKMS asks kmsKeyID to mint a fresh CEK and returns both the plaintext
+// CEK and its KMS-encrypted form, bound to desc via KMS's encryption
+// context so KMS only unwraps it when given the same desc.
+func wrapKMS(ctx context.Context, client KMSAPI, kmsKeyID string, desc matDesc) (cek, wrapped []byte, err error) {
+	out, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             &kmsKeyID,
+		KeySpec:           kmstypes.DataKeySpecAes256,
+		EncryptionContext: desc,
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "kms:GenerateDataKey")
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// unwrapKMS recovers the CEK kms:GenerateDataKey produced, re-presenting
+// desc as the encryption context so KMS refuses to unwrap a CEK that was
+// bound to a different material description.
+func unwrapKMS(ctx context.Context, client KMSAPI, wrapped []byte, desc matDesc) ([]byte, error) {
+	out, err := client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    wrapped,
+		EncryptionContext: desc,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "kms:Decrypt")
+	}
+	return out.Plaintext, nil
+}
+
+// wrapLocal seals cek under kek with a fresh GCM nonce and no additional
+// authenticated data (unlike a KMS-wrapped key, a locally wrapped one is
+// not bound to the matdesc): the nonce is prepended to the returned blob
+// so unwrapLocal is self-contained given only kek.
+func wrapLocal(kek, cek []byte) ([]byte, error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := generateBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, cek, nil), nil
+}
+
+// unwrapLocal reverses wrapLocal.
+func unwrapLocal(kek, wrapped []byte) ([]byte, error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped CEK shorter than GCM nonce")
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	cek, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unwrapping CEK")
+	}
+	return cek, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3dest turns the `--s3-*` object governance flags into the
+// PutObjectInput fields they name, so compliance-driven users can push a
+// tagged, encrypted, WORM-protected tarball in one kaniko build instead of
+// patching object metadata afterwards. It applies equally to a single-shot
+// PutObject and to s3uploader's multipart path: Apply is meant to run on
+// the PutObjectInput the caller builds before handing it to either one.
+package s3dest
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+)
+
+// Flags mirrors the raw `--s3-*` flag values, one field per flag.
+type Flags struct {
+	// StorageClass is --s3-storage-class, e.g. "STANDARD_IA", "GLACIER".
+	StorageClass string
+	// SSE is --s3-sse, the server-side encryption mode, e.g. "AES256" or
+	// "aws:kms".
+	SSE string
+	// SSEKMSKeyID is --s3-sse-kms-key-id. Only meaningful when SSE is a
+	// KMS mode.
+	SSEKMSKeyID string
+	// SSEKMSContext is --s3-sse-kms-context, the base64-encoded JSON KMS
+	// encryption context.
+	SSEKMSContext string
+	// Tags is --s3-tag, repeatable, each "key=value".
+	Tags []string
+	// ObjectLockMode is --s3-object-lock-mode, "GOVERNANCE" or
+	// "COMPLIANCE".
+	ObjectLockMode string
+	// ObjectLockRetainUntil is --s3-object-lock-retain-until, an RFC3339
+	// timestamp.
+	ObjectLockRetainUntil string
+	// ObjectLockLegalHold is --s3-object-lock-legal-hold, "on" or "off".
+	ObjectLockLegalHold string
+	// RequestPayer is --s3-request-payer, e.g. "requester", acknowledging
+	// that the caller (not the bucket owner) pays for a requester-pays
+	// bucket's request and transfer costs.
+	RequestPayer string
+	// ExpectedBucketOwner is --s3-expected-bucket-owner, the account ID
+	// the destination bucket must belong to. S3 fails the request with
+	// AccessDenied instead of silently hitting the wrong account's
+	// bucket if this doesn't match.
+	ExpectedBucketOwner string
+}
+
+// Destination is Flags, parsed and validated into the types PutObjectInput
+// actually wants.
+type Destination struct {
+	StorageClass              types.StorageClass
+	ServerSideEncryption      types.ServerSideEncryption
+	SSEKMSKeyID               *string
+	SSEKMSEncryptionContext   *string
+	Tagging                   *string
+	ObjectLockMode            types.ObjectLockMode
+	ObjectLockRetainUntilDate *time.Time
+	ObjectLockLegalHoldStatus types.ObjectLockLegalHoldStatus
+	RequestPayer              types.RequestPayer
+	ExpectedBucketOwner       *string
+}
+
+// Parse validates f and returns the Destination it describes. Every field
+// is optional; an all-zero Flags parses to an all-zero Destination whose
+// Apply is a no-op.
+func Parse(f Flags) (*Destination, error) {
+	d := &Destination{
+		StorageClass:         types.StorageClass(f.StorageClass),
+		ServerSideEncryption: types.ServerSideEncryption(f.SSE),
+		ObjectLockMode:       types.ObjectLockMode(f.ObjectLockMode),
+		RequestPayer:         types.RequestPayer(f.RequestPayer),
+	}
+
+	if f.ExpectedBucketOwner != "" {
+		d.ExpectedBucketOwner = &f.ExpectedBucketOwner
+	}
+	if f.SSEKMSKeyID != "" {
+		d.SSEKMSKeyID = &f.SSEKMSKeyID
+	}
+	if f.SSEKMSContext != "" {
+		if f.SSE == "" {
+			return nil, errors.New("s3dest: --s3-sse-kms-context requires --s3-sse to select a KMS mode")
+		}
+		d.SSEKMSEncryptionContext = &f.SSEKMSContext
+	}
+
+	if len(f.Tags) > 0 {
+		tagging, err := parseTags(f.Tags)
+		if err != nil {
+			return nil, err
+		}
+		d.Tagging = &tagging
+	}
+
+	if f.ObjectLockRetainUntil != "" {
+		t, err := time.Parse(time.RFC3339, f.ObjectLockRetainUntil)
+		if err != nil {
+			return nil, errors.Wrap(err, "s3dest: parsing --s3-object-lock-retain-until")
+		}
+		d.ObjectLockRetainUntilDate = &t
+	}
+
+	switch strings.ToLower(f.ObjectLockLegalHold) {
+	case "":
+	case "on":
+		d.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOn
+	case "off":
+		d.ObjectLockLegalHoldStatus = types.ObjectLockLegalHoldStatusOff
+	default:
+		return nil, errors.Errorf("s3dest: --s3-object-lock-legal-hold must be \"on\" or \"off\", got %q", f.ObjectLockLegalHold)
+	}
+
+	return d, nil
+}
+
+// parseTags turns repeated "key=value" --s3-tag flags into the
+// URL-query-encoded string Tagging expects, the same "key1=value1&..."
+// form `RUN --mount=type=secret`-style repeated flags elsewhere in kaniko
+// get folded into a single value.
+func parseTags(tags []string) (string, error) {
+	values := url.Values{}
+	for _, t := range tags {
+		key, value, found := strings.Cut(t, "=")
+		if !found || key == "" {
+			return "", errors.Errorf("s3dest: --s3-tag %q must be in key=value form", t)
+		}
+		values.Set(key, value)
+	}
+	return values.Encode(), nil
+}
+
+// Apply sets every field Parse populated onto in, leaving fields Flags
+// didn't mention untouched.
+func (d *Destination) Apply(in *s3.PutObjectInput) {
+	if d.StorageClass != "" {
+		in.StorageClass = d.StorageClass
+	}
+	if d.ServerSideEncryption != "" {
+		in.ServerSideEncryption = d.ServerSideEncryption
+	}
+	if d.SSEKMSKeyID != nil {
+		in.SSEKMSKeyId = d.SSEKMSKeyID
+	}
+	if d.SSEKMSEncryptionContext != nil {
+		in.SSEKMSEncryptionContext = d.SSEKMSEncryptionContext
+	}
+	if d.Tagging != nil {
+		in.Tagging = d.Tagging
+	}
+	if d.ObjectLockMode != "" {
+		in.ObjectLockMode = d.ObjectLockMode
+	}
+	if d.ObjectLockRetainUntilDate != nil {
+		in.ObjectLockRetainUntilDate = d.ObjectLockRetainUntilDate
+	}
+	if d.ObjectLockLegalHoldStatus != "" {
+		in.ObjectLockLegalHoldStatus = d.ObjectLockLegalHoldStatus
+	}
+	if d.RequestPayer != "" {
+		in.RequestPayer = d.RequestPayer
+	}
+	if d.ExpectedBucketOwner != nil {
+		in.ExpectedBucketOwner = d.ExpectedBucketOwner
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3uploader
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumAlgorithm selects which flight-time integrity checksum the
+// uploader computes and sends with each request, set via
+// --s3-checksum-algorithm. This is in addition to, not instead of, S3's
+// own ETag/MD5 check: it catches corruption between kaniko and S3 instead
+// of only corruption S3 itself already wrote down.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumCRC32C ChecksumAlgorithm = "CRC32C"
+	ChecksumCRC32  ChecksumAlgorithm = "CRC32"
+	ChecksumSHA1   ChecksumAlgorithm = "SHA1"
+	ChecksumSHA256 ChecksumAlgorithm = "SHA256"
+)
+
+// DefaultChecksumAlgorithm matches the AWS SDK's own default for
+// PutObjectInput.ChecksumAlgorithm.
+const DefaultChecksumAlgorithm = ChecksumCRC32C
+
+func newChecksumHasher(alg ChecksumAlgorithm) (hash.Hash, error) {
+	switch alg {
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, errors.Errorf("s3uploader: unsupported checksum algorithm %q", alg)
+	}
+}
+
+// sumChecksum hashes b - already fully buffered in memory by Upload, so
+// this is the only pass over it - and returns both the base64 form a
+// ChecksumXXX field expects and the raw digest bytes compositeSum needs.
+func sumChecksum(alg ChecksumAlgorithm, b []byte) (b64 string, raw []byte, err error) {
+	h, err := newChecksumHasher(alg)
+	if err != nil {
+		return "", nil, err
+	}
+	h.Write(b) // hash.Hash.Write never returns an error
+	raw = h.Sum(nil)
+	return base64.StdEncoding.EncodeToString(raw), raw, nil
+}
+
+// verifyEchoedChecksum compares sum - the checksum Upload computed and
+// sent - against echoed, the value S3 returned in its response. A real
+// bucket always echoes one back once a checksum was requested, so this
+// catches corruption introduced between kaniko and S3 instead of only
+// trusting that the bytes S3 wrote down are the bytes kaniko meant to
+// send. echoed == "" is treated as "nothing to check against" rather
+// than an error, since some S3-compatible stores don't implement
+// checksum echoing at all.
+func verifyEchoedChecksum(sum, echoed string) error {
+	if echoed == "" || echoed == sum {
+		return nil
+	}
+	return errors.Errorf("checksum mismatch: sent %s, S3 returned %s", sum, echoed)
+}
+
+// compositeSum reproduces S3's multipart "composite" checksum: the same
+// algorithm applied, in part order, to the concatenation of each part's
+// raw checksum. S3 marks the result as composite (as opposed to a
+// whole-object digest) by appending "-N", N being the part count.
+func compositeSum(alg ChecksumAlgorithm, partSums [][]byte) (string, error) {
+	h, err := newChecksumHasher(alg)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range partSums {
+		h.Write(s)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(partSums)), nil
+}
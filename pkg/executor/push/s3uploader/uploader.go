@@ -0,0 +1,468 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3uploader streams an image tarball to S3 without ever holding
+// the whole tar in memory. Kaniko builds the tarball into a pipe as layers
+// are written, so by the time `--tarball-path s3://...` is ready to push,
+// the body is an io.Reader of unknown length that can easily exceed the
+// 5GiB single-PUT limit. Uploader buffers just enough to fill one part,
+// then falls back to a single PutObject for anything that fits in it, or
+// drives a concurrent multipart upload (modeled on the AWS SDK's
+// s3manager.Uploader) for anything bigger.
+package s3uploader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPartSize is the size of each buffered part, matching
+// s3manager.DefaultUploadPartSize.
+const DefaultPartSize = 5 * 1024 * 1024 // 5MiB
+
+// DefaultConcurrency is the number of parts uploaded in parallel,
+// matching s3manager.DefaultUploadConcurrency.
+const DefaultConcurrency = 5
+
+// API is the subset of *s3.Client the uploader needs. Tests supply a fake
+// implementation instead of talking to real S3.
+type API interface {
+	PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// Options configures an Uploader.
+type Options struct {
+	// PartSize is the size, in bytes, buffered for each part before it is
+	// handed to a worker. Defaults to DefaultPartSize. The body is only
+	// ever sent as a single PutObject if it is smaller than one part.
+	PartSize int64
+	// Concurrency is the number of UploadPart calls in flight at once.
+	// Defaults to DefaultConcurrency.
+	Concurrency int
+	// ChecksumAlgorithm is the flight-time integrity checksum computed
+	// over each part (or the whole body, for a single PutObject) and sent
+	// alongside it, set via --s3-checksum-algorithm. Defaults to
+	// DefaultChecksumAlgorithm.
+	ChecksumAlgorithm ChecksumAlgorithm
+}
+
+func (o Options) withDefaults() Options {
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.ChecksumAlgorithm == "" {
+		o.ChecksumAlgorithm = DefaultChecksumAlgorithm
+	}
+	return o
+}
+
+// ProgressFunc is called, from worker goroutines, after each part (or the
+// whole body, for a single-PUT upload) has been durably sent. Callers that
+// need a running total should accumulate it themselves; n is the size of
+// the chunk just sent, not a cumulative count.
+type ProgressFunc func(n int64)
+
+// Uploader drives PutObject/multipart uploads against API, buffering just
+// enough of the input stream to decide which strategy applies.
+type Uploader struct {
+	client API
+	opts   Options
+}
+
+// NewUploader returns an Uploader that issues requests through client.
+func NewUploader(client API, opts Options) *Uploader {
+	return &Uploader{client: client, opts: opts.withDefaults()}
+}
+
+// Output is the result of a successful Upload.
+type Output struct {
+	// ETag is the uploaded object's ETag. For a multipart upload this is
+	// S3's multipart ETag (a hash of the parts' ETags, not the object's
+	// MD5), matching what PutObject/CompleteMultipartUpload each return.
+	ETag string
+	// UploadID is non-empty if Upload used a multipart upload.
+	UploadID string
+	// ServerSideEncryption and SSEKMSKeyID echo back the at-rest
+	// encryption S3 actually applied, so a caller can log or assert
+	// against it rather than just trust the request it sent.
+	ServerSideEncryption types.ServerSideEncryption
+	SSEKMSKeyID          string
+}
+
+// Upload sends in.Body to S3, reading it to completion. For bodies smaller
+// than one part it issues a single PutObject; otherwise it performs a
+// multipart upload, buffering and sending opts.Concurrency parts at once.
+// progress may be nil.
+//
+// On any part failure, Upload cancels the remaining uploads, best-effort
+// aborts the multipart upload so S3 doesn't bill for the orphaned parts,
+// and returns the first error seen.
+func (u *Uploader) Upload(ctx context.Context, in *s3.PutObjectInput, progress ProgressFunc) (*Output, error) {
+	if in.Body == nil {
+		in.Body = bytes.NewReader(nil)
+	}
+
+	first := make([]byte, u.opts.PartSize)
+	n, err := io.ReadFull(in.Body, first)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		return u.putSingle(ctx, in, first[:n], progress)
+	case err != nil:
+		return nil, errors.Wrap(err, "reading first part")
+	}
+
+	return u.uploadMultipart(ctx, in, first[:n], progress)
+}
+
+func (u *Uploader) putSingle(ctx context.Context, in *s3.PutObjectInput, body []byte, progress ProgressFunc) (*Output, error) {
+	sum, _, err := sumChecksum(u.opts.ChecksumAlgorithm, body)
+	if err != nil {
+		return nil, err
+	}
+
+	put := *in
+	put.Body = bytes.NewReader(body)
+	applyPutChecksum(&put, u.opts.ChecksumAlgorithm, sum)
+	out, err := u.client.PutObject(ctx, &put)
+	if err != nil {
+		return nil, errors.Wrap(err, "PutObject")
+	}
+	if err := verifyEchoedChecksum(sum, echoedPutChecksum(out, u.opts.ChecksumAlgorithm)); err != nil {
+		return nil, errors.Wrap(err, "PutObject")
+	}
+	if progress != nil {
+		progress(int64(len(body)))
+	}
+	return &Output{
+		ETag:                 aws.ToString(out.ETag),
+		ServerSideEncryption: out.ServerSideEncryption,
+		SSEKMSKeyID:          aws.ToString(out.SSEKMSKeyId),
+	}, nil
+}
+
+// uploadMultipart drives CreateMultipartUpload/UploadPart/
+// CompleteMultipartUpload. firstPart is the chunk Upload already buffered
+// while probing whether the body fit in a single PutObject.
+func (u *Uploader) uploadMultipart(ctx context.Context, in *s3.PutObjectInput, firstPart []byte, progress ProgressFunc) (*Output, error) {
+	created, err := u.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                    in.Bucket,
+		Key:                       in.Key,
+		ACL:                       in.ACL,
+		BucketKeyEnabled:          in.BucketKeyEnabled,
+		CacheControl:              in.CacheControl,
+		ContentDisposition:        in.ContentDisposition,
+		ContentEncoding:           in.ContentEncoding,
+		ContentLanguage:           in.ContentLanguage,
+		ContentType:               in.ContentType,
+		ExpectedBucketOwner:       in.ExpectedBucketOwner,
+		Metadata:                  in.Metadata,
+		ObjectLockLegalHoldStatus: in.ObjectLockLegalHoldStatus,
+		ObjectLockMode:            in.ObjectLockMode,
+		ObjectLockRetainUntilDate: in.ObjectLockRetainUntilDate,
+		RequestPayer:              in.RequestPayer,
+		ServerSideEncryption:      in.ServerSideEncryption,
+		SSEKMSEncryptionContext:   in.SSEKMSEncryptionContext,
+		SSEKMSKeyId:               in.SSEKMSKeyId,
+		StorageClass:              in.StorageClass,
+		Tagging:                   in.Tagging,
+		ChecksumAlgorithm:         types.ChecksumAlgorithm(u.opts.ChecksumAlgorithm),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateMultipartUpload")
+	}
+	uploadID := created.UploadId
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		partSums = make(map[int32][]byte)
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, u.opts.Concurrency)
+	)
+
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		mu.Unlock()
+	}
+
+	dispatch := func(partNumber int32, body []byte) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Hashed once, here, over the bytes Upload already buffered
+			// for this part - never re-read from the source stream.
+			sum, raw, err := sumChecksum(u.opts.ChecksumAlgorithm, body)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			partInput := &s3.UploadPartInput{
+				Bucket:              in.Bucket,
+				Key:                 in.Key,
+				UploadId:            uploadID,
+				PartNumber:          &partNumber,
+				Body:                bytes.NewReader(body),
+				RequestPayer:        in.RequestPayer,
+				ExpectedBucketOwner: in.ExpectedBucketOwner,
+			}
+			applyUploadPartChecksum(partInput, u.opts.ChecksumAlgorithm, sum)
+
+			out, err := u.client.UploadPart(ctx, partInput)
+			if err != nil {
+				// Any retries of the client's own retryer have already
+				// happened inside UploadPart. The error it returns is
+				// wrapped, not swallowed, so errors.Cause still yields
+				// it; Upload does not re-send the part itself - the
+				// first failure cancels the other parts and aborts.
+				fail(errors.Wrapf(err, "UploadPart %d", partNumber))
+				return
+			}
+			if err := verifyEchoedChecksum(sum, echoedUploadPartChecksum(out, u.opts.ChecksumAlgorithm)); err != nil {
+				fail(errors.Wrapf(err, "UploadPart %d", partNumber))
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: &partNumber})
+			partSums[partNumber] = raw
+			mu.Unlock()
+
+			if progress != nil {
+				progress(int64(len(body)))
+			}
+		}()
+	}
+
+	partNumber := int32(1)
+	dispatch(partNumber, firstPart)
+
+	buf := make([]byte, u.opts.PartSize)
+readLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			break readLoop
+		default:
+		}
+
+		n, err := io.ReadFull(in.Body, buf)
+		if n > 0 {
+			partNumber++
+			body := make([]byte, n)
+			copy(body, buf[:n])
+			dispatch(partNumber, body)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fail(errors.Wrap(err, "reading part"))
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		u.abort(in, uploadID)
+		return nil, firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+
+	partSumsInOrder := make([][]byte, len(parts))
+	for i, p := range parts {
+		partSumsInOrder[i] = partSums[*p.PartNumber]
+	}
+	composite, err := compositeSum(u.opts.ChecksumAlgorithm, partSumsInOrder)
+	if err != nil {
+		u.abort(in, uploadID)
+		return nil, err
+	}
+
+	completeInput := &s3.CompleteMultipartUploadInput{
+		Bucket:              in.Bucket,
+		Key:                 in.Key,
+		UploadId:            uploadID,
+		MultipartUpload:     &types.CompletedMultipartUpload{Parts: parts},
+		RequestPayer:        in.RequestPayer,
+		ExpectedBucketOwner: in.ExpectedBucketOwner,
+	}
+	applyCompleteChecksum(completeInput, u.opts.ChecksumAlgorithm, composite)
+
+	out, err := u.client.CompleteMultipartUpload(ctx, completeInput)
+	if err != nil {
+		u.abort(in, uploadID)
+		return nil, errors.Wrap(err, "CompleteMultipartUpload")
+	}
+	if err := verifyEchoedChecksum(composite, echoedCompleteChecksum(out, u.opts.ChecksumAlgorithm)); err != nil {
+		u.abort(in, uploadID)
+		return nil, errors.Wrap(err, "CompleteMultipartUpload")
+	}
+
+	return &Output{
+		ETag:                 aws.ToString(out.ETag),
+		UploadID:             aws.ToString(uploadID),
+		ServerSideEncryption: out.ServerSideEncryption,
+		SSEKMSKeyID:          aws.ToString(out.SSEKMSKeyId),
+	}, nil
+}
+
+// applyPutChecksum sets the ChecksumXXX field matching alg, plus
+// ChecksumAlgorithm itself, so the SDK knows which one it is.
+func applyPutChecksum(in *s3.PutObjectInput, alg ChecksumAlgorithm, sum string) {
+	in.ChecksumAlgorithm = types.ChecksumAlgorithm(alg)
+	switch alg {
+	case ChecksumCRC32C:
+		in.ChecksumCRC32C = &sum
+	case ChecksumCRC32:
+		in.ChecksumCRC32 = &sum
+	case ChecksumSHA1:
+		in.ChecksumSHA1 = &sum
+	case ChecksumSHA256:
+		in.ChecksumSHA256 = &sum
+	}
+}
+
+// applyUploadPartChecksum is applyPutChecksum's UploadPartInput
+// counterpart; UploadPartInput has no ChecksumAlgorithm field of its own,
+// since that's fixed for the whole upload by CreateMultipartUploadInput.
+func applyUploadPartChecksum(in *s3.UploadPartInput, alg ChecksumAlgorithm, sum string) {
+	switch alg {
+	case ChecksumCRC32C:
+		in.ChecksumCRC32C = &sum
+	case ChecksumCRC32:
+		in.ChecksumCRC32 = &sum
+	case ChecksumSHA1:
+		in.ChecksumSHA1 = &sum
+	case ChecksumSHA256:
+		in.ChecksumSHA256 = &sum
+	}
+}
+
+// applyCompleteChecksum sets the composite whole-object checksum
+// CompleteMultipartUpload expects, for S3 to verify against what it
+// assembled from the individual parts' own checksums.
+func applyCompleteChecksum(in *s3.CompleteMultipartUploadInput, alg ChecksumAlgorithm, sum string) {
+	switch alg {
+	case ChecksumCRC32C:
+		in.ChecksumCRC32C = &sum
+	case ChecksumCRC32:
+		in.ChecksumCRC32 = &sum
+	case ChecksumSHA1:
+		in.ChecksumSHA1 = &sum
+	case ChecksumSHA256:
+		in.ChecksumSHA256 = &sum
+	}
+}
+
+// echoedPutChecksum reads back whichever ChecksumXXX field alg selects
+// from a PutObjectOutput, the applyPutChecksum counterpart.
+func echoedPutChecksum(out *s3.PutObjectOutput, alg ChecksumAlgorithm) string {
+	switch alg {
+	case ChecksumCRC32C:
+		return aws.ToString(out.ChecksumCRC32C)
+	case ChecksumCRC32:
+		return aws.ToString(out.ChecksumCRC32)
+	case ChecksumSHA1:
+		return aws.ToString(out.ChecksumSHA1)
+	case ChecksumSHA256:
+		return aws.ToString(out.ChecksumSHA256)
+	default:
+		return ""
+	}
+}
+
+// echoedUploadPartChecksum is echoedPutChecksum's UploadPartOutput
+// counterpart.
+func echoedUploadPartChecksum(out *s3.UploadPartOutput, alg ChecksumAlgorithm) string {
+	switch alg {
+	case ChecksumCRC32C:
+		return aws.ToString(out.ChecksumCRC32C)
+	case ChecksumCRC32:
+		return aws.ToString(out.ChecksumCRC32)
+	case ChecksumSHA1:
+		return aws.ToString(out.ChecksumSHA1)
+	case ChecksumSHA256:
+		return aws.ToString(out.ChecksumSHA256)
+	default:
+		return ""
+	}
+}
+
+// echoedCompleteChecksum is echoedPutChecksum's CompleteMultipartUploadOutput
+// counterpart. It reads back the composite checksum applyCompleteChecksum
+// sent, not a per-part value.
+func echoedCompleteChecksum(out *s3.CompleteMultipartUploadOutput, alg ChecksumAlgorithm) string {
+	switch alg {
+	case ChecksumCRC32C:
+		return aws.ToString(out.ChecksumCRC32C)
+	case ChecksumCRC32:
+		return aws.ToString(out.ChecksumCRC32)
+	case ChecksumSHA1:
+		return aws.ToString(out.ChecksumSHA1)
+	case ChecksumSHA256:
+		return aws.ToString(out.ChecksumSHA256)
+	default:
+		return ""
+	}
+}
+
+// abort best-effort releases a failed multipart upload's parts so S3
+// doesn't keep billing for them. Its own error is logged, not returned:
+// the caller already has a real error to report, and an abort failure
+// just means the bucket's lifecycle rule for incomplete uploads (if any)
+// has to clean up instead.
+func (u *Uploader) abort(in *s3.PutObjectInput, uploadID *string) {
+	_, err := u.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:              in.Bucket,
+		Key:                 in.Key,
+		UploadId:            uploadID,
+		RequestPayer:        in.RequestPayer,
+		ExpectedBucketOwner: in.ExpectedBucketOwner,
+	})
+	if err != nil {
+		logrus.Warnf("s3uploader: aborting multipart upload %s: %v", aws.ToString(uploadID), err)
+	}
+}
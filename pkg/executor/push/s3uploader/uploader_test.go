@@ -0,0 +1,172 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3uploader
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeAPI records every request it sees and, like a real bucket, echoes
+// back the checksum each request carried. Every call succeeds: each
+// UploadPart gets an ETag, and CompleteMultipartUpload does not check
+// which parts were uploaded.
+type fakeAPI struct {
+	puts      []*s3.PutObjectInput
+	creates   []*s3.CreateMultipartUploadInput
+	parts     []*s3.UploadPartInput
+	completes []*s3.CompleteMultipartUploadInput
+	aborts    []*s3.AbortMultipartUploadInput
+}
+
+func (f *fakeAPI) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, in)
+	return &s3.PutObjectOutput{ETag: aws.String("etag"), ChecksumCRC32C: in.ChecksumCRC32C, ChecksumSHA256: in.ChecksumSHA256}, nil
+}
+
+func (f *fakeAPI) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.creates = append(f.creates, in)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-id")}, nil
+}
+
+func (f *fakeAPI) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	f.parts = append(f.parts, in)
+	return &s3.UploadPartOutput{ETag: aws.String("part-etag"), ChecksumCRC32C: in.ChecksumCRC32C, ChecksumSHA256: in.ChecksumSHA256}, nil
+}
+
+func (f *fakeAPI) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completes = append(f.completes, in)
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String("final-etag"), ChecksumCRC32C: in.ChecksumCRC32C, ChecksumSHA256: in.ChecksumSHA256}, nil
+}
+
+func (f *fakeAPI) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborts = append(f.aborts, in)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func newPutObjectInput(body []byte) *s3.PutObjectInput {
+	return &s3.PutObjectInput{
+		Bucket:              aws.String("bucket"),
+		Key:                 aws.String("key"),
+		Body:                bytes.NewReader(body),
+		RequestPayer:        types.RequestPayerRequester,
+		ExpectedBucketOwner: aws.String("111122223333"),
+	}
+}
+
+// TestUpload_SinglePart_PropagatesRequestPayerHeaders asserts a body
+// smaller than one part carries --s3-request-payer / --s3-expected-
+// bucket-owner through to the single PutObject call.
+func TestUpload_SinglePart_PropagatesRequestPayerHeaders(t *testing.T) {
+	fake := &fakeAPI{}
+	u := NewUploader(fake, Options{PartSize: 1024})
+
+	if _, err := u.Upload(context.Background(), newPutObjectInput([]byte("small body")), nil); err != nil {
+		t.Fatalf("Upload: %s", err)
+	}
+
+	if len(fake.puts) != 1 {
+		t.Fatalf("expected 1 PutObject call, got %d", len(fake.puts))
+	}
+	if fake.puts[0].RequestPayer != types.RequestPayerRequester {
+		t.Errorf("PutObject missing RequestPayer")
+	}
+	if aws.ToString(fake.puts[0].ExpectedBucketOwner) != "111122223333" {
+		t.Errorf("PutObject missing ExpectedBucketOwner")
+	}
+}
+
+// TestUpload_Multipart_PropagatesRequestPayerHeaders asserts every
+// multipart sub-request - create, each part, and complete - carries the
+// same two headers as the original PutObjectInput.
+func TestUpload_Multipart_PropagatesRequestPayerHeaders(t *testing.T) {
+	fake := &fakeAPI{}
+	u := NewUploader(fake, Options{PartSize: 8, Concurrency: 2})
+
+	body := bytes.Repeat([]byte("x"), 8*3+1) // spans 4 parts at PartSize 8
+	if _, err := u.Upload(context.Background(), newPutObjectInput(body), nil); err != nil {
+		t.Fatalf("Upload: %s", err)
+	}
+
+	if len(fake.creates) != 1 {
+		t.Fatalf("expected 1 CreateMultipartUpload call, got %d", len(fake.creates))
+	}
+	if fake.creates[0].RequestPayer != types.RequestPayerRequester {
+		t.Errorf("CreateMultipartUpload missing RequestPayer")
+	}
+	if aws.ToString(fake.creates[0].ExpectedBucketOwner) != "111122223333" {
+		t.Errorf("CreateMultipartUpload missing ExpectedBucketOwner")
+	}
+
+	if len(fake.parts) != 4 {
+		t.Fatalf("expected 4 UploadPart calls, got %d", len(fake.parts))
+	}
+	for i, p := range fake.parts {
+		if p.RequestPayer != types.RequestPayerRequester {
+			t.Errorf("UploadPart %d missing RequestPayer", i)
+		}
+		if aws.ToString(p.ExpectedBucketOwner) != "111122223333" {
+			t.Errorf("UploadPart %d missing ExpectedBucketOwner", i)
+		}
+	}
+
+	if len(fake.completes) != 1 {
+		t.Fatalf("expected 1 CompleteMultipartUpload call, got %d", len(fake.completes))
+	}
+	if fake.completes[0].RequestPayer != types.RequestPayerRequester {
+		t.Errorf("CompleteMultipartUpload missing RequestPayer")
+	}
+	if aws.ToString(fake.completes[0].ExpectedBucketOwner) != "111122223333" {
+		t.Errorf("CompleteMultipartUpload missing ExpectedBucketOwner")
+	}
+
+	if len(fake.aborts) != 0 {
+		t.Fatalf("expected no AbortMultipartUpload calls, got %d", len(fake.aborts))
+	}
+}
+
+// corruptingAPI behaves like fakeAPI's PutObject except it echoes back a
+// checksum that doesn't match what was sent, simulating corruption
+// between kaniko and S3.
+type corruptingAPI struct {
+	fakeAPI
+}
+
+func (f *corruptingAPI) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	out, err := f.fakeAPI.PutObject(ctx, in, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	bogus := "not-the-right-checksum"
+	out.ChecksumCRC32C = &bogus
+	return out, nil
+}
+
+func TestUpload_SinglePart_DetectsChecksumMismatch(t *testing.T) {
+	fake := &corruptingAPI{}
+	u := NewUploader(fake, Options{PartSize: 1024})
+
+	_, err := u.Upload(context.Background(), newPutObjectInput([]byte("small body")), nil)
+	if err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+// FilesystemUnwrapper is implemented by decorators built with Decorate so
+// that callers which need to reach past a wrapper - to type-assert the
+// base afero.Fs for a capability like afero.Lstater, for instance - can
+// walk back down the stack one layer at a time instead of having to know
+// the whole chain up front.
+type FilesystemUnwrapper interface {
+	// UnwrapFilesystem returns the Filesystem this decorator wraps.
+	UnwrapFilesystem() Filesystem
+}
+
+// Decorate applies decorators to base in order, the way hugofs builds its
+// filesystem stacks: each decorator wraps the result of the previous one,
+// so the first decorator in the list sits directly on base and the last
+// one ends up outermost.
+//
+//	fs := Decorate(NewFS(afero.NewOsFs()), WithCopyOnWrite(layer), WithReadOnlyGuard())
+//
+// produces a read-only guard wrapping a copy-on-write overlay wrapping the
+// OS filesystem.
+func Decorate(base Filesystem, decorators ...func(Filesystem) Filesystem) Filesystem {
+	fs := base
+	for _, decorate := range decorators {
+		fs = decorate(fs)
+	}
+	return fs
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMemoryFS_SymlinkRoundtrip(t *testing.T) {
+	fs := NewMemoryFS()
+
+	if err := afero.WriteFile(fs, "/real.txt", []byte("hi"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := fs.Symlink("/real.txt", "/link.txt"); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	fi, err := fs.Lstat("/link.txt")
+	if err != nil {
+		t.Fatalf("Lstat: %s", err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected Lstat on a symlink to report ModeSymlink, got %v", fi.Mode())
+	}
+
+	target, err := fs.Readlink("/link.txt")
+	if err != nil {
+		t.Fatalf("Readlink: %s", err)
+	}
+	if target != "/real.txt" {
+		t.Errorf("Readlink = %q, want /real.txt", target)
+	}
+}
+
+func TestMemoryFS_Hardlink(t *testing.T) {
+	fs := NewMemoryFS()
+
+	if err := afero.WriteFile(fs, "/a.txt", []byte("content"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := fs.Link("/a.txt", "/b.txt"); err != nil {
+		t.Fatalf("Link: %s", err)
+	}
+
+	got, err := afero.ReadFile(fs, "/b.txt")
+	if err != nil {
+		t.Fatalf("ReadFile via hardlink: %s", err)
+	}
+	if string(got) != "content" {
+		t.Errorf("ReadFile via hardlink = %q, want %q", got, "content")
+	}
+}
+
+func TestReadOnlyGuard_RejectsWrites(t *testing.T) {
+	fs := Decorate(NewMemoryFS(), WithReadOnlyGuard())
+
+	err := fs.Mkdir("/newdir", 0o755)
+	if !isEROFS(err) {
+		t.Fatalf("Mkdir under read-only guard = %v, want syscall.EROFS", err)
+	}
+}
+
+func isEROFS(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.EROFS
+}
+
+func TestFromKind_UnknownIsError(t *testing.T) {
+	if _, err := FromKind(Kind("bogus")); err == nil {
+		t.Error("expected an error for an unknown Kind, got nil")
+	}
+}
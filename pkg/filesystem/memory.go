@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// NewMemoryFS returns a Filesystem backed entirely by memory
+// (afero.NewMemMapFs), for running a build off-disk in ephemeral CI
+// runners and in tests that otherwise need root to exercise hardlinks.
+//
+// afero.MemMapFs has no notion of symlinks or hardlinks, which kaniko's
+// snapshotter and COPY/ADD commands both rely on, so NewMemoryFS layers a
+// small shim on top that tracks them itself: Symlink/Readlink/Link are
+// served from an in-memory table rather than delegated to the underlying
+// afero.Fs, and Lstat resolves a symlinked path one level without
+// following it, mirroring the real syscall's behavior.
+func NewMemoryFS() Filesystem {
+	return &memoryFS{
+		Filesystem: NewFS(afero.NewMemMapFs()),
+		symlinks:   map[string]string{},
+		hardlinks:  map[string]string{},
+	}
+}
+
+type memoryFS struct {
+	Filesystem
+
+	mu        sync.RWMutex
+	symlinks  map[string]string // path -> link target
+	hardlinks map[string]string // path -> canonical path it was linked from
+}
+
+func (m *memoryFS) UnwrapFilesystem() Filesystem { return m.Filesystem }
+
+func (m *memoryFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.symlinks[newname] = oldname
+	return nil
+}
+
+func (m *memoryFS) Readlink(name string) (string, error) {
+	m.mu.RLock()
+	target, ok := m.symlinks[name]
+	m.mu.RUnlock()
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrInvalid}
+	}
+	return target, nil
+}
+
+func (m *memoryFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	m.hardlinks[newname] = m.canonical(oldname)
+	m.mu.Unlock()
+	return nil
+}
+
+// canonical follows the hardlink table (not symlinks - those stay
+// distinct paths with their own entry) to the path a file was originally
+// created at, so every name in a hardlink group resolves to one inode's
+// worth of content in the backing MemMapFs.
+func (m *memoryFS) canonical(path string) string {
+	for {
+		target, ok := m.hardlinks[path]
+		if !ok {
+			return path
+		}
+		path = target
+	}
+}
+
+func (m *memoryFS) Open(name string) (afero.File, error) {
+	return m.Filesystem.Open(m.resolveHardlink(name))
+}
+
+func (m *memoryFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return m.Filesystem.OpenFile(m.resolveHardlink(name), flag, perm)
+}
+
+func (m *memoryFS) resolveHardlink(name string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.canonical(name)
+}
+
+func (m *memoryFS) Lstat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	target, isSymlink := m.symlinks[name]
+	m.mu.RUnlock()
+	if isSymlink {
+		return &symlinkInfo{name: filepath.Base(name), target: target}, nil
+	}
+	return m.Filesystem.Stat(m.resolveHardlink(name))
+}
+
+// symlinkInfo is the os.FileInfo kaniko sees for a path the memory shim
+// knows is a symlink; it never follows the link, matching os.Lstat.
+type symlinkInfo struct {
+	name   string
+	target string
+}
+
+func (s *symlinkInfo) Name() string       { return s.name }
+func (s *symlinkInfo) Size() int64        { return int64(len(s.target)) }
+func (s *symlinkInfo) Mode() os.FileMode  { return os.ModeSymlink | 0o777 }
+func (s *symlinkInfo) ModTime() time.Time { return time.Time{} }
+func (s *symlinkInfo) IsDir() bool        { return false }
+func (s *symlinkInfo) Sys() interface{}   { return nil }
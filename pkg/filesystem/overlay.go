@@ -0,0 +1,73 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// WithCopyOnWrite returns a decorator that layers layer on top of a base
+// Filesystem using afero.NewCopyOnWriteFs: reads fall through to base,
+// while writes and the file it first touches land only in layer. This
+// lets kaniko keep the image it started a build from read-only and write
+// only the diff a RUN or COPY command produces to a scratch layer, rather
+// than mutating base in place - useful both for the in-memory build mode
+// and for snapshotting against a base image mounted read-only.
+func WithCopyOnWrite(layer Filesystem) func(Filesystem) Filesystem {
+	return func(base Filesystem) Filesystem {
+		return &copyOnWriteFS{
+			Filesystem: NewFS(afero.NewCopyOnWriteFs(base, layer)),
+			base:       base,
+			layer:      layer,
+		}
+	}
+}
+
+type copyOnWriteFS struct {
+	Filesystem
+	base, layer Filesystem
+}
+
+func (c *copyOnWriteFS) UnwrapFilesystem() Filesystem { return c.base }
+
+// Lstat, Readlink and Link aren't part of afero.Fs, so
+// afero.NewCopyOnWriteFs doesn't know to route them: prefer the layer
+// (where anything written through this decorator actually lives) and
+// fall back to the base image.
+func (c *copyOnWriteFS) Lstat(name string) (os.FileInfo, error) {
+	if fi, err := c.layer.Lstat(name); err == nil {
+		return fi, nil
+	}
+	return c.base.Lstat(name)
+}
+
+func (c *copyOnWriteFS) Readlink(name string) (string, error) {
+	if target, err := c.layer.Readlink(name); err == nil {
+		return target, nil
+	}
+	return c.base.Readlink(name)
+}
+
+func (c *copyOnWriteFS) Link(oldname, newname string) error {
+	return c.layer.Link(oldname, newname)
+}
+
+func (c *copyOnWriteFS) Symlink(oldname, newname string) error {
+	return c.layer.Symlink(oldname, newname)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// WithReadOnlyGuard returns a decorator that fails every write with
+// syscall.EROFS instead of reaching the wrapped Filesystem, so a caller
+// that's only supposed to be inspecting a filesystem - reading a base
+// image's contents to answer a cache probe, say - can't accidentally
+// mutate it even if a bug elsewhere tries to.
+func WithReadOnlyGuard() func(Filesystem) Filesystem {
+	return func(base Filesystem) Filesystem {
+		return &readOnlyFS{Filesystem: base}
+	}
+}
+
+type readOnlyFS struct {
+	Filesystem
+}
+
+func (r *readOnlyFS) UnwrapFilesystem() Filesystem { return r.Filesystem }
+
+func errReadOnly(op, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: syscall.EROFS}
+}
+
+func (r *readOnlyFS) Create(name string) (afero.File, error) {
+	return nil, errReadOnly("create", name)
+}
+
+func (r *readOnlyFS) Mkdir(name string, perm os.FileMode) error {
+	return errReadOnly("mkdir", name)
+}
+
+func (r *readOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	return errReadOnly("mkdir", path)
+}
+
+func (r *readOnlyFS) Remove(name string) error {
+	return errReadOnly("remove", name)
+}
+
+func (r *readOnlyFS) RemoveAll(path string) error {
+	return errReadOnly("remove", path)
+}
+
+func (r *readOnlyFS) Rename(oldname, newname string) error {
+	return errReadOnly("rename", oldname)
+}
+
+func (r *readOnlyFS) Chmod(name string, mode os.FileMode) error {
+	return errReadOnly("chmod", name)
+}
+
+func (r *readOnlyFS) Chown(name string, uid, gid int) error {
+	return errReadOnly("chown", name)
+}
+
+func (r *readOnlyFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return errReadOnly("chtimes", name)
+}
+
+func (r *readOnlyFS) Link(oldname, newname string) error {
+	return errReadOnly("link", newname)
+}
+
+func (r *readOnlyFS) Symlink(oldname, newname string) error {
+	return errReadOnly("symlink", newname)
+}
+
+func (r *readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, errReadOnly("open", name)
+	}
+	return r.Filesystem.OpenFile(name, flag, perm)
+}
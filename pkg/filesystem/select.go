@@ -0,0 +1,56 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"fmt"
+
+	"github.com/spf13/afero"
+)
+
+// Kind names one of the backends FromKind knows how to build, and is the
+// value space for the executor's --filesystem flag.
+type Kind string
+
+const (
+	// KindOS is the default: build directly against the real filesystem.
+	KindOS Kind = "os"
+	// KindMemory runs an entire build off-disk, for ephemeral CI runners
+	// and tests that would otherwise need root to exercise hardlinks.
+	KindMemory Kind = "memory"
+	// KindOverlay keeps the OS filesystem as a read-only base and writes
+	// the build's diff to an in-memory layer on top of it.
+	KindOverlay Kind = "overlay"
+)
+
+// FromKind builds the Filesystem named by kind, for wiring up
+// KanikoOptions.FilesystemKind (the --filesystem flag) ahead of a build or
+// cache probe. An unrecognized kind is an error rather than a silent
+// fallback to KindOS, so a typo in the flag doesn't quietly run a build
+// against the real disk.
+func FromKind(kind Kind) (Filesystem, error) {
+	switch kind {
+	case "", KindOS:
+		return NewFS(afero.NewOsFs()), nil
+	case KindMemory:
+		return NewMemoryFS(), nil
+	case KindOverlay:
+		return Decorate(NewFS(afero.NewOsFs()), WithCopyOnWrite(NewMemoryFS())), nil
+	default:
+		return nil, fmt.Errorf("unknown filesystem kind %q, want one of %q, %q, %q", kind, KindOS, KindMemory, KindOverlay)
+	}
+}
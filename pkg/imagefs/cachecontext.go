@@ -0,0 +1,289 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagefs
+
+import (
+	"archive/tar"
+	"container/list"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/util"
+)
+
+// FileInfo is the fs.FileInfo a CacheContext hands back for a cached path.
+// It's an alias, not a new type, so callers don't need anything from this
+// package beyond the stdlib fs.FileInfo methods.
+type FileInfo = fs.FileInfo
+
+// DefaultMaxCacheContexts bounds the process-wide CacheContext LRU (see
+// SetMaxCacheContexts) absent a config.KanikoOptions override.
+const DefaultMaxCacheContexts = 20
+
+// CacheContext holds the walk-time file cache New populates, keyed by the
+// base image's manifest digest rather than by root: this mirrors
+// BuildKit's GetCacheContext/SetCacheContext split and means a Dockerfile
+// whose stages share a base image only pays for walking and hashing that
+// image's layers once, no matter how many COPY/RUN cache probes consult
+// it afterwards.
+type CacheContext struct {
+	digest   string
+	platform string
+	sysStat  func(hdr *tar.Header) interface{}
+
+	mu    sync.RWMutex
+	files map[string]imageFSFile // path (root-joined) -> cached entry
+	dirs  map[string]*cachedDir  // path -> cached directory listing
+	// requested tracks, per root, which filesToCache patterns New has
+	// already walked the layers for, so a later New call with the same
+	// (or a subset of the same) patterns can skip the walk entirely.
+	requested map[string]map[string]bool
+}
+
+func newCacheContext(digest, platform string) *CacheContext {
+	return &CacheContext{
+		digest:    digest,
+		platform:  platform,
+		sysStat:   sysStatFor(platform),
+		files:     make(map[string]imageFSFile),
+		dirs:      make(map[string]*cachedDir),
+		requested: make(map[string]map[string]bool),
+	}
+}
+
+// Files returns every path cached for root so far, keyed the same way
+// New's internal cache is: the root-joined path New was given.
+func (c *CacheContext) Files(root string) map[string]FileInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make(map[string]FileInfo)
+	for path, fi := range c.files {
+		if underRoot(root, path) {
+			out[path] = fi
+		}
+	}
+	return out
+}
+
+// Checksum returns the content hash New computed for root's path, the
+// same MD5 sum util.CacheHasher would produce walking the live
+// filesystem. It errors if path hasn't been cached for root (a New call
+// with a filesToCache pattern covering it hasn't run yet) or was cached
+// only as the parent directory of a requested path, which carries no
+// content hash. A directory a pattern matched itself has a hash.
+func (c *CacheContext) Checksum(root, path string) ([]byte, error) {
+	full := filepath.Join(root, path)
+
+	c.mu.RLock()
+	fi, ok := c.files[full]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("imagefs: %s not cached for %s", path, root)
+	}
+	summer, ok := fi.(util.CacheHasherFileInfoSum)
+	if !ok {
+		return nil, fmt.Errorf("imagefs: %s has no content checksum", path)
+	}
+	return summer.MD5Sum()
+}
+
+// Invalidate drops every entry this CacheContext holds for root, plus its
+// record of which filesToCache patterns root has already requested, so
+// the next New call against root walks its layers again from scratch.
+func (c *CacheContext) Invalidate(root string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.files {
+		if underRoot(root, path) {
+			delete(c.files, path)
+			delete(c.dirs, path)
+		}
+	}
+	delete(c.requested, root)
+}
+
+// reserve returns the subset of filesToCache that root hasn't asked this
+// CacheContext for before, recording all of filesToCache as requested in
+// the process. An empty result means every pattern was already walked for
+// on an earlier New call and the caller can skip the walk outright.
+func (c *CacheContext) reserve(root string, filesToCache []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := c.requested[root]
+	if seen == nil {
+		seen = make(map[string]bool, len(filesToCache))
+		c.requested[root] = seen
+	}
+
+	missing := make([]string, 0, len(filesToCache))
+	for _, f := range filesToCache {
+		if !seen[f] {
+			missing = append(missing, f)
+			seen[f] = true
+		}
+	}
+	return missing
+}
+
+func (c *CacheContext) has(path string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.files[path]
+	return ok
+}
+
+func (c *CacheContext) file(path string) (imageFSFile, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fi, ok := c.files[path]
+	return fi, ok
+}
+
+func (c *CacheContext) set(path string, fi imageFSFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[path] = fi
+}
+
+func (c *CacheContext) dirEntries(pattern string) ([]fs.DirEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for dir, d := range c.dirs {
+		if ok, err := filepath.Match(pattern, dir); ok && err == nil {
+			return d.entry, true
+		}
+	}
+	return nil, false
+}
+
+// rebuildDirs refreshes every cached directory's listing from the current
+// contents of c.files. It's called once after each walk rather than
+// incrementally, which is simpler and cheap enough: the number of cached
+// directories in a build's base image is small next to the layer walk
+// that just happened.
+func (c *CacheContext) rebuildDirs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path, d := range c.files {
+		if !d.IsDir() {
+			continue
+		}
+		cd, ok := c.dirs[path]
+		if !ok {
+			cd = &cachedDir{FileInfo: d}
+			c.dirs[path] = cd
+		}
+		cd.entry = cd.entry[:0]
+		for name, fi := range c.files {
+			if filepath.Dir(name) == path {
+				cd.entry = append(cd.entry, fi)
+			}
+		}
+	}
+}
+
+// underRoot reports whether path is root itself or lives under it.
+func underRoot(root, path string) bool {
+	if path == root {
+		return true
+	}
+	prefix := root
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// cacheContexts is the process-wide LRU New consults before walking an
+// image's layers, keyed by manifest digest.
+var cacheContexts = newCacheContextLRU(DefaultMaxCacheContexts)
+
+// SetMaxCacheContexts resizes the process-wide CacheContext LRU. kaniko's
+// executor calls this once at startup, from the
+// config.KanikoOptions.ImageFSCacheSize flag (DefaultMaxCacheContexts
+// absent an override); New itself never needs to know the bound.
+func SetMaxCacheContexts(n int) {
+	cacheContexts.resize(n)
+}
+
+type cacheContextLRU struct {
+	mu       sync.Mutex
+	max      int
+	order    *list.List // front = most recently used
+	byDigest map[string]*list.Element
+}
+
+type cacheContextLRUEntry struct {
+	digest string
+	cc     *CacheContext
+}
+
+func newCacheContextLRU(max int) *cacheContextLRU {
+	return &cacheContextLRU{
+		max:      max,
+		order:    list.New(),
+		byDigest: make(map[string]*list.Element),
+	}
+}
+
+func (s *cacheContextLRU) getOrCreate(digest, platform string) *CacheContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.byDigest[digest]; ok {
+		s.order.MoveToFront(el)
+		return el.Value.(*cacheContextLRUEntry).cc
+	}
+
+	cc := newCacheContext(digest, platform)
+	el := s.order.PushFront(&cacheContextLRUEntry{digest: digest, cc: cc})
+	s.byDigest[digest] = el
+	s.evictLocked()
+	return cc
+}
+
+func (s *cacheContextLRU) resize(max int) {
+	if max < 1 {
+		max = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = max
+	s.evictLocked()
+}
+
+func (s *cacheContextLRU) evictLocked() {
+	for s.order.Len() > s.max {
+		back := s.order.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*cacheContextLRUEntry)
+		delete(s.byDigest, entry.digest)
+		s.order.Remove(back)
+		logrus.Debugf("imagefs: evicted CacheContext for image %s (LRU over %d entries)", entry.digest, s.max)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagefs
+
+import (
+	"io/fs"
+	"time"
+)
+
+// FileStat is a platform-neutral stand-in for the handful of syscall.Stat_t
+// fields kaniko's cache path actually reads off a cached file. Everything
+// that needs to look past fs.FileInfo - permissions bits aside - should
+// read a FileStat rather than type-asserting FileInfo.Sys() to a specific
+// OS's stat type, so that a Windows (or any other non-Linux) base image
+// doesn't have to fake up a syscall.Stat_t that doesn't mean anything on
+// its platform.
+type FileStat struct {
+	Mode     fs.FileMode
+	Uid      uint32
+	Gid      uint32
+	Size     int64
+	Atime    time.Time
+	Ctime    time.Time
+	Mtime    time.Time
+	Linkname string
+}
+
+// ContainerFS is a read-only view onto one image root cached by imageFS,
+// modeled on Docker's containerfs.ContainerFS: a caller asks for the root
+// it cares about, the platform that root's image was built for, and stats
+// by path without ever needing to know whether the answer came from the
+// real filesystem or imageFS's tar-header cache.
+type ContainerFS interface {
+	// Path is the root this ContainerFS was obtained for.
+	Path() string
+	// Platform is the value of the image's ConfigFile().OS, e.g. "linux"
+	// or "windows".
+	Platform() string
+	Stat(name string) (FileStat, error)
+	Lstat(name string) (FileStat, error)
+}
+
+// ContainerFS returns a ContainerFS view of root, which must already have
+// been registered with ifs via New.
+func (ifs *imageFS) ContainerFS(root string) (ContainerFS, error) {
+	ifs.mu.RLock()
+	_, ok := ifs.image[root]
+	ifs.mu.RUnlock()
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &containerFS{ifs: ifs, root: root}, nil
+}
+
+type containerFS struct {
+	ifs  *imageFS
+	root string
+}
+
+func (c *containerFS) Path() string { return c.root }
+
+func (c *containerFS) Platform() string {
+	c.ifs.mu.RLock()
+	defer c.ifs.mu.RUnlock()
+	return c.ifs.ctx[c.root].platform
+}
+
+func (c *containerFS) Stat(name string) (FileStat, error) {
+	fi, err := c.ifs.Stat(name)
+	if err != nil {
+		return FileStat{}, err
+	}
+	return toFileStat(fi), nil
+}
+
+func (c *containerFS) Lstat(name string) (FileStat, error) {
+	fi, err := c.ifs.Lstat(name)
+	if err != nil {
+		return FileStat{}, err
+	}
+	return toFileStat(fi), nil
+}
+
+// toFileStat builds a FileStat out of an fs.FileInfo. For entries imageFS
+// cached itself (a *cachedFileInfo, or one wrapped in
+// *cachedFileInfoWithMD5Sum) it fills every field from the tar.Header that
+// produced it; for anything passed through to the real filesystem it can
+// only report what fs.FileInfo already carries, since that interface has
+// no notion of uid/gid/link targets.
+func toFileStat(fi fs.FileInfo) FileStat {
+	stat := FileStat{
+		Mode:  fi.Mode(),
+		Size:  fi.Size(),
+		Mtime: fi.ModTime(),
+	}
+
+	cf, ok := fi.(*cachedFileInfo)
+	if !ok {
+		if withSum, ok := fi.(*cachedFileInfoWithMD5Sum); ok {
+			cf = withSum.cachedFileInfo
+		}
+	}
+	if cf != nil {
+		stat.Uid = uint32(cf.hdr.Uid)
+		stat.Gid = uint32(cf.hdr.Gid)
+		stat.Linkname = cf.hdr.Linkname
+		stat.Atime = cf.hdr.AccessTime
+		stat.Ctime = cf.hdr.ChangeTime
+	}
+	return stat
+}
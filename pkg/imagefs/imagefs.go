@@ -27,7 +27,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/pkg/errors"
@@ -42,8 +41,11 @@ type imageFS struct {
 
 	mu    sync.RWMutex // Protects following.
 	image map[string]v1.Image
-	dirs  map[string]*cachedDir
-	files map[string]imageFSFile
+	// ctx maps each root New has populated to the CacheContext backing
+	// it. Two roots can share a CacheContext when they're built from the
+	// same image digest, which is the whole point of splitting the cache
+	// out: see cachecontext.go.
+	ctx map[string]*CacheContext
 }
 
 type imageFSFile interface {
@@ -57,11 +59,6 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 		return nil, errors.New("imagefs: image cannot be nil")
 	}
 
-	layers, err := image.Layers()
-	if err != nil {
-		return nil, errors.Wrap(err, "imagefs: get layers failed")
-	}
-
 	var ifs *imageFS
 	// Multiple layers of imageFS might get confusing, enable delayering.
 	if pfs, ok := parent.(*imageFS); ok {
@@ -71,17 +68,43 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 		if _, ok := pfs.image[root]; ok {
 			return nil, fmt.Errorf("imagefs: root already exists: %s", root)
 		}
-		pfs.image[root] = image
 		ifs = pfs
 	} else {
 		ifs = &imageFS{
 			FS:    vfs.NewReadOnlyFS(parent),
-			image: map[string]v1.Image{root: image},
-			dirs:  make(map[string]*cachedDir),
-			files: make(map[string]imageFSFile),
+			image: make(map[string]v1.Image),
+			ctx:   make(map[string]*CacheContext),
 		}
 	}
 
+	digest, err := image.Digest()
+	if err != nil {
+		return nil, errors.Wrap(err, "imagefs: get image digest failed")
+	}
+	platform := "linux"
+	if cfg, err := image.ConfigFile(); err == nil && cfg.OS != "" {
+		platform = cfg.OS
+	}
+	cc := cacheContexts.getOrCreate(digest.String(), platform)
+
+	ifs.image[root] = image
+	ifs.ctx[root] = cc
+
+	// Only the patterns this root hasn't asked CacheContext for before
+	// need a walk; if it's asked for all of them already (the common case
+	// for a second COPY/RUN cache probe against the same base image),
+	// skip touching the layers entirely.
+	missing := cc.reserve(root, filesToCache)
+	if len(missing) == 0 {
+		logrus.Debugf("imagefs: CacheContext hit for %s (image %s), skipping walk", root, digest)
+		return ifs, nil
+	}
+
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "imagefs: get layers failed")
+	}
+
 	logrus.Debugf("imagefs: Caching files for %s", root)
 
 	// Keep track of directories so we can cache all of their contents.
@@ -92,10 +115,16 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 		cleanedName = strings.TrimPrefix(cleanedName, "/")
 		path := filepath.Join(dest, cleanedName)
 
+		if cc.has(path) {
+			// A previous walk of this image digest for the same root
+			// (paths are root-joined) already cached this path.
+			return nil
+		}
+
 		cacheFile := func() error {
 			logrus.Debugf("imagefs: Found cacheable file /%s (path=%s) (%d:%d)", cleanedName, path, hdr.Uid, hdr.Gid)
 
-			cf := newCachedFileInfo(path, hdr)
+			cf := newCachedFileInfo(path, hdr, cc.sysStat)
 			if cf.IsDir() {
 				dirsToCache = append(dirsToCache, cleanedName)
 			}
@@ -104,7 +133,7 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 			if err != nil {
 				return errors.Wrap(err, "imagefs: hash file failed")
 			}
-			ifs.files[path] = newCachedFileInfoWithMD5Sum(cf, sum)
+			cc.set(path, newCachedFileInfoWithMD5Sum(cf, sum))
 
 			return nil
 		}
@@ -116,7 +145,7 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 			}
 		}
 
-		for _, f := range filesToCache {
+		for _, f := range missing {
 			f = strings.TrimPrefix(f, "/")
 			f = strings.TrimSuffix(f, "/")
 
@@ -127,9 +156,9 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 
 			// Cache parent directories for directory lookups.
 			if cleanedName == "" || strings.HasPrefix(f, cleanedName+"/") {
-				if _, ok := ifs.files[path]; !ok {
+				if !cc.has(path) {
 					logrus.Debugf("imagefs: Found cacheable file parent /%s (file=/%s)", cleanedName, f)
-					ifs.files[path] = newCachedFileInfo(dest, hdr)
+					cc.set(path, newCachedFileInfo(dest, hdr, cc.sysStat))
 				}
 			}
 		}
@@ -141,19 +170,7 @@ func New(parent vfs.FS, root string, image v1.Image, filesToCache []string) (vfs
 	}
 
 	logrus.Debugf("imagefs: Creating cached directories for %s", root)
-
-	for dir, d := range ifs.files {
-		if !d.IsDir() {
-			continue
-		}
-		ifs.dirs[dir] = &cachedDir{FileInfo: d}
-		for name, fi := range ifs.files {
-			if filepath.Dir(name) == dir {
-				ifs.dirs[dir].entry = append(ifs.dirs[dir].entry, fi)
-			}
-		}
-	}
-
+	cc.rebuildDirs()
 	logrus.Debugf("imagefs: Cached files for %s", root)
 
 	return ifs, nil
@@ -165,11 +182,9 @@ func (ifs *imageFS) Open(name string) (fs.File, error) {
 		return f, nil
 	}
 
-	ifs.mu.RLock()
-	defer ifs.mu.RUnlock()
-	if ifs.files[name] != nil {
+	if fi, ok := ifs.lookup(name); ok {
 		logrus.Debugf("imagefs: Open cached file %s", name)
-		return ifs.files[name], nil
+		return fi, nil
 	}
 	return nil, fs.ErrNotExist
 }
@@ -180,11 +195,9 @@ func (ifs *imageFS) Lstat(name string) (fs.FileInfo, error) {
 		return fi, nil
 	}
 
-	ifs.mu.RLock()
-	defer ifs.mu.RUnlock()
-	if ifs.files[name] != nil {
+	if fi, ok := ifs.lookup(name); ok {
 		logrus.Debugf("imagefs: Lstat cached file %s", name)
-		return ifs.files[name], nil
+		return fi, nil
 	}
 	return nil, fs.ErrNotExist
 }
@@ -195,11 +208,9 @@ func (ifs *imageFS) Stat(name string) (fs.FileInfo, error) {
 		return fi, nil
 	}
 
-	ifs.mu.RLock()
-	defer ifs.mu.RUnlock()
-	if ifs.files[name] != nil {
+	if fi, ok := ifs.lookup(name); ok {
 		logrus.Debugf("imagefs: Stat cached file %s", name)
-		return ifs.files[name], nil
+		return fi, nil
 	}
 	return nil, fs.ErrNotExist
 }
@@ -210,17 +221,36 @@ func (ifs *imageFS) ReadDir(name string) ([]fs.DirEntry, error) {
 		return de, nil
 	}
 
-	ifs.mu.RLock()
-	defer ifs.mu.RUnlock()
-	for dir, d := range ifs.dirs {
-		if ok, err := filepath.Match(name, dir); ok && err == nil {
+	for _, cc := range ifs.contexts() {
+		if entry, ok := cc.dirEntries(name); ok {
 			logrus.Debugf("imagefs: Reading cached directory %s", name)
-			return d.entry, nil
+			return entry, nil
 		}
 	}
 	return nil, fs.ErrNotExist
 }
 
+// lookup searches every CacheContext this imageFS has a root registered
+// against for name; a delayered imageFS can have several, one per root.
+func (ifs *imageFS) lookup(name string) (imageFSFile, bool) {
+	for _, cc := range ifs.contexts() {
+		if fi, ok := cc.file(name); ok {
+			return fi, true
+		}
+	}
+	return nil, false
+}
+
+func (ifs *imageFS) contexts() []*CacheContext {
+	ifs.mu.RLock()
+	defer ifs.mu.RUnlock()
+	ctxs := make([]*CacheContext, 0, len(ifs.ctx))
+	for _, cc := range ifs.ctx {
+		ctxs = append(ctxs, cc)
+	}
+	return ctxs
+}
+
 type cachedDir struct {
 	fs.FileInfo
 	entry []fs.DirEntry
@@ -230,15 +260,15 @@ type cachedFileInfo struct {
 	fs.FileInfo
 	path string
 	hdr  *tar.Header
-	sys  *syscall.Stat_t
+	sys  interface{}
 }
 
-func newCachedFileInfo(path string, hdr *tar.Header) *cachedFileInfo {
+func newCachedFileInfo(path string, hdr *tar.Header, sysStat func(hdr *tar.Header) interface{}) *cachedFileInfo {
 	return &cachedFileInfo{
 		FileInfo: hdr.FileInfo(),
 		path:     path,
 		hdr:      hdr,
-		sys:      tarHeaderToStat_t(hdr),
+		sys:      sysStat(hdr),
 	}
 }
 
@@ -291,20 +321,6 @@ func (cf *cachedFileInfoWithMD5Sum) MD5Sum() ([]byte, error) {
 	return cf.md5sum, nil
 }
 
-// tarHeaderToStat_t converts a tar.Header to a syscall.Stat_t.
-func tarHeaderToStat_t(hdr *tar.Header) *syscall.Stat_t {
-	fi := hdr.FileInfo()
-	return &syscall.Stat_t{
-		Mode: uint32(fi.Mode()),
-		Uid:  uint32(hdr.Uid),
-		Gid:  uint32(hdr.Gid),
-		Size: fi.Size(),
-		Atim: timespec(hdr.AccessTime),
-		Ctim: timespec(hdr.ChangeTime),
-		Mtim: timespec(fi.ModTime()),
-	}
-}
-
 // hashFile hashes the gievn file, implementation must match util.CacheHasher.
 func hashFile(hdr *tar.Header, r io.Reader) ([]byte, error) {
 	fi := hdr.FileInfo()
@@ -0,0 +1,56 @@
+//go:build linux
+
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagefs
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// sysStatFor picks the sysStat adapter for an image's target platform.
+// kaniko itself only runs on Linux, but the image it's building can target
+// any OS a base layer was produced for, so this switches on the image's
+// declared platform rather than runtime.GOOS.
+func sysStatFor(platform string) func(hdr *tar.Header) interface{} {
+	if platform == "windows" {
+		return sysStatWindows
+	}
+	return sysStatLinux
+}
+
+// sysStatLinux continues to synthesize a syscall.Stat_t, for the callers
+// that still type-assert FileInfo.Sys() the old way instead of going
+// through ContainerFS.Stat/Lstat's platform-neutral FileStat.
+func sysStatLinux(hdr *tar.Header) interface{} {
+	return tarHeaderToStat_t(hdr)
+}
+
+// tarHeaderToStat_t converts a tar.Header to a syscall.Stat_t.
+func tarHeaderToStat_t(hdr *tar.Header) *syscall.Stat_t {
+	fi := hdr.FileInfo()
+	return &syscall.Stat_t{
+		Mode: uint32(fi.Mode()),
+		Uid:  uint32(hdr.Uid),
+		Gid:  uint32(hdr.Gid),
+		Size: fi.Size(),
+		Atim: timespec(hdr.AccessTime),
+		Ctim: timespec(hdr.ChangeTime),
+		Mtim: timespec(fi.ModTime()),
+	}
+}
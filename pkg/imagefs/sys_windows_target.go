@@ -0,0 +1,49 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagefs
+
+import (
+	"archive/tar"
+	"time"
+)
+
+// winSecurityDescriptorPAXRecord is the PAX record key Windows container
+// base images (and Docker/containerd's tar writers) use to carry a file's
+// raw Windows security descriptor through a tar layer.
+const winSecurityDescriptorPAXRecord = "MSWINDOWS.rawsd"
+
+// winStat is the Windows analogue of syscall.Stat_t: kaniko's builder only
+// ever runs on Linux, so there's no real Windows stat_t to synthesize, but
+// an LCOW base image's tar headers still carry enough PAX metadata to
+// round-trip the bits a Windows-targeting consumer needs.
+type winStat struct {
+	Size               int64
+	Mtime              time.Time
+	SecurityDescriptor string
+}
+
+// sysStatWindows builds the FileInfo.Sys() value for a file from a
+// Windows-targeted image, pulling the security descriptor out of the tar
+// header's PAX records rather than a host syscall type.
+func sysStatWindows(hdr *tar.Header) interface{} {
+	fi := hdr.FileInfo()
+	return &winStat{
+		Size:               fi.Size(),
+		Mtime:              fi.ModTime(),
+		SecurityDescriptor: hdr.PAXRecords[winSecurityDescriptorPAXRecord],
+	}
+}
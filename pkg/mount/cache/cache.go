@@ -0,0 +1,174 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cache implements the backing store for `RUN --mount=type=cache`
+// mounts. Each cache id is materialized as a directory on disk that
+// survives across RUN invocations (and, once persisted, across builds) so
+// that package manager caches and similar workloads don't start cold on
+// every layer.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Sharing mirrors the `sharing` field of `RUN --mount=type=cache`.
+type Sharing string
+
+const (
+	// SharingShared allows multiple concurrent RUNs to use the same cache
+	// directory at once. This is the default.
+	SharingShared Sharing = "shared"
+	// SharingPrivate is accepted, but Mount handles it exactly like
+	// SharingShared: the RUN gets the same directory as every other RUN
+	// with this cache id and command hash, and no per-RUN copy is made.
+	SharingPrivate Sharing = "private"
+	// SharingLocked serializes access to the cache directory with a file
+	// lock so only one RUN can hold it at a time.
+	SharingLocked Sharing = "locked"
+)
+
+// Options describes a single `--mount=type=cache` mount.
+type Options struct {
+	// ID is the cache id (the mount's `id=` field, defaulting to Target).
+	ID string
+	// Target is the path inside the build container the cache is mounted at.
+	Target string
+	// Sharing controls how concurrent RUNs contend for the cache directory.
+	Sharing Sharing
+	// Mode, UID and GID are applied to the cache directory root the first
+	// time it is created.
+	Mode os.FileMode
+	UID  int
+	GID  int
+	// RunCommandHash, when set, is folded into the cache key so that a
+	// cache id reused across semantically different RUN commands does not
+	// collide. It is optional: omitting it allows the cache to be shared
+	// across commands that agree on its contents out of band.
+	RunCommandHash string
+}
+
+// Manager materializes cache-mount directories under a root directory
+// (typically a subdirectory of kConfig.CacheDir) and hands out locks for
+// the "locked" sharing mode.
+type Manager struct {
+	root string
+
+	mu    sync.Mutex
+	locks map[string]*flock.Flock
+}
+
+// NewManager returns a Manager rooted at root. The directory is created
+// lazily on first use.
+func NewManager(root string) *Manager {
+	return &Manager{
+		root:  root,
+		locks: make(map[string]*flock.Flock),
+	}
+}
+
+// Mount returns the on-disk directory backing opts, creating it if
+// necessary, and a release function that must be called once the RUN that
+// requested the mount has finished. Release is a no-op unless the mount
+// uses SharingLocked, in which case it unlocks the cache for the next
+// RUN that wants it.
+func (m *Manager) Mount(opts Options) (dir string, release func() error, err error) {
+	if opts.ID == "" {
+		opts.ID = opts.Target
+	}
+	if opts.Sharing == "" {
+		opts.Sharing = SharingShared
+	}
+
+	key := CacheKey(opts.ID, opts.RunCommandHash)
+	dir = filepath.Join(m.root, key)
+
+	if opts.Sharing == SharingLocked {
+		release, err = m.lock(dir)
+		if err != nil {
+			return "", nil, errors.Wrapf(err, "locking cache mount %s", opts.ID)
+		}
+	} else {
+		release = func() error { return nil }
+	}
+
+	if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+		mode := opts.Mode
+		if mode == 0 {
+			mode = 0o755
+		}
+		logrus.Debugf("cache: creating mount directory %s for cache id %s", dir, opts.ID)
+		if err := os.MkdirAll(dir, mode); err != nil {
+			return "", nil, errors.Wrapf(err, "creating cache mount directory %s", dir)
+		}
+		if opts.UID != 0 || opts.GID != 0 {
+			if err := os.Chown(dir, opts.UID, opts.GID); err != nil {
+				return "", nil, errors.Wrapf(err, "chowning cache mount directory %s", dir)
+			}
+		}
+	}
+
+	return dir, release, nil
+}
+
+// lock acquires an exclusive flock on dir+".lock", blocking until it is
+// available, and returns a function that releases it.
+func (m *Manager) lock(dir string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	fl, ok := m.locks[dir]
+	if !ok {
+		fl = flock.New(dir + ".lock")
+		m.locks[dir] = fl
+	}
+	m.mu.Unlock()
+
+	if err := fl.Lock(); err != nil {
+		return nil, err
+	}
+	return fl.Unlock, nil
+}
+
+// CacheKey derives the on-disk directory name for a cache mount from its
+// id and (optionally) the hash of the RUN command it is attached to, so
+// that cache reuse across builds stays safe: two RUNs that share a cache
+// id but disagree about the command producing it don't silently share
+// state. The key intentionally does not depend on the cache directory's
+// own content - the directory is a long-lived, mutable store that RUNs
+// read from and write to in place, not a snapshot restored by digest, so
+// there is nothing to content-address until after a RUN has already
+// chosen (and possibly created) the directory it writes into.
+func CacheKey(id, runCommandHash string) string {
+	return Digest(id + "\x00" + runCommandHash)
+}
+
+// Digest returns the sha256 hex digest of s. It is used for short string
+// keys (cache ids, command hashes) rather than file content.
+func Digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheKey_DiffersByCommandHash(t *testing.T) {
+	a := CacheKey("my-cache", "hash-a")
+	b := CacheKey("my-cache", "hash-b")
+	if a == b {
+		t.Errorf("expected CacheKey to differ for different command hashes, both got %s", a)
+	}
+	if a != CacheKey("my-cache", "hash-a") {
+		t.Errorf("expected CacheKey to be deterministic for the same inputs")
+	}
+}
+
+func TestMount_CreatesAndReusesDirectory(t *testing.T) {
+	root := t.TempDir()
+	m := NewManager(root)
+
+	dir, release, err := m.Mount(Options{ID: "pip-cache", RunCommandHash: "cmd-hash"})
+	if err != nil {
+		t.Fatalf("Mount: %s", err)
+	}
+	if err := release(); err != nil {
+		t.Fatalf("release: %s", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected cache directory to exist, stat err = %s", err)
+	}
+
+	marker := filepath.Join(dir, "marker")
+	if err := os.WriteFile(marker, []byte("present"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir2, release2, err := m.Mount(Options{ID: "pip-cache", RunCommandHash: "cmd-hash"})
+	if err != nil {
+		t.Fatalf("Mount: %s", err)
+	}
+	defer release2()
+	if dir2 != dir {
+		t.Errorf("expected the same cache id and command hash to resolve to the same directory, got %s and %s", dir, dir2)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected marker written by the first Mount to survive, stat err = %s", err)
+	}
+}
+
+func TestMount_DefaultsIDToTarget(t *testing.T) {
+	root := t.TempDir()
+	m := NewManager(root)
+
+	dir, release, err := m.Mount(Options{Target: "/var/cache/apt"})
+	if err != nil {
+		t.Fatalf("Mount: %s", err)
+	}
+	defer release()
+
+	want := filepath.Join(root, CacheKey("/var/cache/apt", ""))
+	if dir != want {
+		t.Errorf("dir = %s, want %s", dir, want)
+	}
+}
+
+// TestMount_Locked_SerializesAccess exercises the flock itself rather than
+// Manager's in-process dedup of *flock.Flock objects: two Managers rooted
+// at the same directory don't share a lock map, so this is the only way to
+// observe the lock actually blocking a second holder.
+func TestMount_Locked_SerializesAccess(t *testing.T) {
+	root := t.TempDir()
+	m1 := NewManager(root)
+	m2 := NewManager(root)
+
+	_, release1, err := m1.Mount(Options{ID: "locked-cache", Sharing: SharingLocked})
+	if err != nil {
+		t.Fatalf("Mount: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, release2, err := m2.Mount(Options{ID: "locked-cache", Sharing: SharingLocked})
+		if err != nil {
+			t.Errorf("Mount: %s", err)
+			close(done)
+			return
+		}
+		release2()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected the second Mount to block until the first lock is released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := release1(); err != nil {
+		t.Fatalf("release: %s", err)
+	}
+	<-done
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// CompressionAlgorithm selects the codec NewCompressedTar uses to compress
+// the tar stream it writes.
+type CompressionAlgorithm string
+
+const (
+	// CompressionGzip produces a standard multistream gzip file: every
+	// block is compressed independently and the members are concatenated,
+	// which compress/gzip's reader (and zcat, pigz, etc.) reads back as a
+	// single continuous stream.
+	CompressionGzip CompressionAlgorithm = "gzip"
+	// CompressionZstd writes a single zstd frame; klauspost/compress
+	// parallelizes its own encoder internally, so no sharding is needed.
+	CompressionZstd CompressionAlgorithm = "zstd"
+)
+
+// defaultBlockSize is the size of each independently gzip-compressed
+// shard, matching pigz's default.
+const defaultBlockSize = 1 << 20 // 1MiB
+
+// CompressionOptions configures NewCompressedTar.
+type CompressionOptions struct {
+	// Algorithm selects the compression codec. Defaults to CompressionGzip.
+	Algorithm CompressionAlgorithm
+	// Level is the codec's compression level. Zero means "use the codec's
+	// own default".
+	Level int
+	// BlockSize is the size, in bytes, that the tar stream is sharded into
+	// before each shard is gzip-compressed in parallel. Ignored for zstd.
+	// Defaults to 1MiB.
+	BlockSize int
+	// Concurrency is the number of shards to compress at once. Defaults to
+	// runtime.GOMAXPROCS(0).
+	Concurrency int
+}
+
+func (o CompressionOptions) withDefaults() CompressionOptions {
+	if o.Algorithm == "" {
+		o.Algorithm = CompressionGzip
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = defaultBlockSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	return o
+}
+
+// NewCompressedTar returns a Tar whose output is compressed and written to
+// w, as selected by opts.Algorithm.
+//
+// With CompressionGzip (the default), the tar byte stream is sharded into
+// opts.BlockSize blocks, gzipped across opts.Concurrency workers (pigz
+// style), and the resulting members are written out in order as soon as
+// they're ready; throughput scales with the number of workers rather than
+// being limited to a single core. With CompressionZstd, writes go straight
+// to a zstd encoder, which parallelizes itself.
+//
+// Callers must call Close on the returned Tar to flush the compressor and
+// any buffered shard before relying on w's contents.
+func NewCompressedTar(w io.Writer, opts CompressionOptions) (Tar, error) {
+	opts = opts.withDefaults()
+
+	switch opts.Algorithm {
+	case CompressionGzip:
+		pgz := newParallelGzipWriter(w, opts.BlockSize, opts.Concurrency, opts.Level)
+		return Tar{w: tar.NewWriter(pgz), closer: pgz}, nil
+	case CompressionZstd:
+		zOpts := []zstd.EOption{zstd.WithEncoderConcurrency(opts.Concurrency)}
+		if opts.Level > 0 {
+			zOpts = append(zOpts, zstd.WithEncoderLevel(zstd.EncoderLevel(opts.Level)))
+		}
+		zw, err := zstd.NewWriter(w, zOpts...)
+		if err != nil {
+			return Tar{}, errors.Wrap(err, "creating zstd writer")
+		}
+		return Tar{w: tar.NewWriter(zw), closer: zw}, nil
+	default:
+		return Tar{}, fmt.Errorf("unsupported compression algorithm %q", opts.Algorithm)
+	}
+}
+
+// parallelGzipWriter buffers writes into fixed-size blocks and compresses
+// each one, concurrently, as an independent gzip member. Members are
+// written to the underlying writer strictly in order, so the output is a
+// deterministic, valid multistream gzip file regardless of which worker
+// finishes first.
+type parallelGzipWriter struct {
+	dst       io.Writer
+	blockSize int
+	level     int
+	sem       chan struct{}
+
+	buf bytes.Buffer
+
+	mu      sync.Mutex
+	seq     int // sequence number assigned to the next dispatched block
+	nextOut int // sequence number of the next block allowed to write to dst
+	pending map[int][]byte
+	wg      sync.WaitGroup
+
+	writeErr error
+}
+
+func newParallelGzipWriter(dst io.Writer, blockSize, concurrency, level int) *parallelGzipWriter {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	pgz := &parallelGzipWriter{
+		dst:       dst,
+		blockSize: blockSize,
+		level:     level,
+		sem:       make(chan struct{}, concurrency),
+		pending:   make(map[int][]byte),
+	}
+	return pgz
+}
+
+// Write implements io.Writer, splitting p into blockSize-sized shards and
+// dispatching each full shard to a worker as soon as it's complete.
+func (p *parallelGzipWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		free := p.blockSize - p.buf.Len()
+		take := free
+		if take > len(b) {
+			take = len(b)
+		}
+		p.buf.Write(b[:take])
+		b = b[take:]
+		if p.buf.Len() >= p.blockSize {
+			if err := p.flushBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flushBlock compresses the currently buffered block in a new worker
+// goroutine and resets the buffer.
+func (p *parallelGzipWriter) flushBlock() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	if err := p.lastErr(); err != nil {
+		return err
+	}
+
+	block := make([]byte, p.buf.Len())
+	copy(block, p.buf.Bytes())
+	p.buf.Reset()
+
+	p.dispatch(block)
+	return nil
+}
+
+// dispatch assigns block the next sequence number and compresses it on a
+// worker goroutine, bounded by the semaphore.
+func (p *parallelGzipWriter) dispatch(block []byte) {
+	p.mu.Lock()
+	seq := p.nextSeq()
+	p.mu.Unlock()
+
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+
+		var buf bytes.Buffer
+		gzw, err := gzip.NewWriterLevel(&buf, p.level)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		if _, err := gzw.Write(block); err != nil {
+			p.fail(err)
+			return
+		}
+		if err := gzw.Close(); err != nil {
+			p.fail(err)
+			return
+		}
+
+		p.emit(seq, buf.Bytes())
+	}()
+}
+
+// nextSeq returns the next monotonically increasing sequence number for
+// this writer. Callers must hold p.mu.
+func (p *parallelGzipWriter) nextSeq() int {
+	seq := p.seq
+	p.seq++
+	return seq
+}
+
+// emit records a worker's compressed output and writes out every
+// consecutive, ready block starting from nextOut.
+func (p *parallelGzipWriter) emit(seq int, compressed []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pending[seq] = compressed
+	for {
+		ready, ok := p.pending[p.nextOut]
+		if !ok {
+			break
+		}
+		delete(p.pending, p.nextOut)
+		if _, err := p.dst.Write(ready); err != nil {
+			p.writeErr = err
+		}
+		p.nextOut++
+	}
+}
+
+func (p *parallelGzipWriter) fail(err error) {
+	p.mu.Lock()
+	if p.writeErr == nil {
+		p.writeErr = err
+	}
+	p.mu.Unlock()
+}
+
+func (p *parallelGzipWriter) lastErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writeErr
+}
+
+// Close flushes any partially-filled block and waits for every in-flight
+// block to be written out, in order.
+func (p *parallelGzipWriter) Close() error {
+	if err := p.flushBlock(); err != nil {
+		return err
+	}
+	p.wg.Wait()
+	return p.lastErr()
+}
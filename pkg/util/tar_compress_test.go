@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_NewCompressedTar_Gzip(t *testing.T) {
+	tmpDir := t.TempDir()
+	createFilesInTempDir(t, tmpDir)
+
+	buf := &bytes.Buffer{}
+	tw, err := NewCompressedTar(buf, CompressionOptions{BlockSize: 16, Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tw.AddFileToTar(filepath.Join(tmpDir, fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	extractedDir := filepath.Join(tmpDir, "extracted")
+	if err := filesystem.FS.Mkdir(extractedDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnTar(buf, extractedDir); err != nil {
+		t.Fatalf("untar: %s", err)
+	}
+}
+
+func benchmarkCompressedTar(b *testing.B, opts CompressionOptions) {
+	tmpDir := b.TempDir()
+	blob := filepath.Join(tmpDir, "blob")
+	data := make([]byte, 8<<20) // 8MiB of random, largely incompressible data
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := filesystem.WriteFile(blob, data, 0o644); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		tw, err := NewCompressedTar(&buf, opts)
+		testutil.CheckError(b, false, err)
+		testutil.CheckError(b, false, tw.AddFileToTar(blob))
+		testutil.CheckError(b, false, tw.Close())
+	}
+}
+
+func BenchmarkNewCompressedTar_Gzip_Concurrency1(b *testing.B) {
+	benchmarkCompressedTar(b, CompressionOptions{Concurrency: 1})
+}
+
+func BenchmarkNewCompressedTar_Gzip_Concurrency4(b *testing.B) {
+	benchmarkCompressedTar(b, CompressionOptions{Concurrency: 4})
+}
+
+func BenchmarkNewCompressedTar_Gzip_Concurrency8(b *testing.B) {
+	benchmarkCompressedTar(b, CompressionOptions{Concurrency: 8})
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// gzipMagic is the two leading bytes of every gzip stream, member or not.
+var gzipMagic = [2]byte{0x1f, 0x8b}
+
+// zstdMagic is the four leading bytes of a zstd frame.
+var zstdMagic = [4]byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Tar writes a set of files to an (optionally compressed) tar stream using
+// kaniko's on-disk layer format: entries are named by their absolute path,
+// so the tarball can be untarred directly on top of a root filesystem.
+type Tar struct {
+	w            *tar.Writer
+	reproducible bool
+	// closer, if set, is closed after w, so that a compressor NewTar was
+	// layered on top of gets flushed too. Only NewCompressedTar sets this.
+	closer io.Closer
+	// entryDigests accumulates the TarSum digest of every entry added via
+	// AddFileToTar, consumed by Sum.
+	entryDigests [][]byte
+}
+
+// NewTar returns a Tar that writes to w, preserving each entry's mtime.
+func NewTar(w io.Writer) Tar {
+	return Tar{w: tar.NewWriter(w)}
+}
+
+// NewReproducibleTar returns a Tar that zeroes every entry's timestamps, so
+// that tarring the same file content twice, in the same order, produces
+// byte-identical output regardless of when it happened.
+func NewReproducibleTar(w io.Writer) Tar {
+	return Tar{w: tar.NewWriter(w), reproducible: true}
+}
+
+// Close flushes the underlying tar writer, and any compressor layered
+// underneath it by NewCompressedTar.
+func (t *Tar) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	if t.closer != nil {
+		return t.closer.Close()
+	}
+	return nil
+}
+
+// AddFileToTar adds the file, directory or symlink at path to the tar
+// stream, using path itself (in /-separated form) as the tar entry name.
+func (t *Tar) AddFileToTar(path string) error {
+	fi, err := filesystem.FS.Lstat(path)
+	if err != nil {
+		return errors.Wrapf(err, "lstat %s", path)
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err = filesystem.FS.Readlink(path)
+		if err != nil {
+			return errors.Wrapf(err, "readlink %s", path)
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return errors.Wrapf(err, "building tar header for %s", path)
+	}
+	hdr.Name = filepath.ToSlash(path)
+
+	if t.reproducible {
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
+	}
+
+	if err := t.w.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "writing tar header for %s", path)
+	}
+
+	if !fi.Mode().IsRegular() {
+		t.entryDigests = append(t.entryDigests, entryDigest(hdr, nil))
+		return nil
+	}
+
+	f, err := filesystem.FS.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	h.Write(canonicalHeaderBytes(hdr))
+	if _, err := io.Copy(io.MultiWriter(t.w, h), f); err != nil {
+		return errors.Wrapf(err, "writing %s to tar", path)
+	}
+	t.entryDigests = append(t.entryDigests, h.Sum(nil))
+	return nil
+}
+
+// CreateTarballOfDirectory writes a gzip-compressed tarball of every file
+// under dir to w.
+func CreateTarballOfDirectory(dir string, w io.Writer) error {
+	_, err := CreateTarballOfDirectoryWithSum(dir, w)
+	return err
+}
+
+// IsFileLocalTarArchive reports whether the file at path is a tar archive,
+// optionally gzip- or zstd-compressed.
+func IsFileLocalTarArchive(path string) bool {
+	f, err := filesystem.FS.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if isTarStream(f) {
+		return true
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+	magic, err := peekMagic(f)
+	if err != nil {
+		return false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+
+	switch {
+	case hasGzipMagic(magic):
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return false
+		}
+		defer gzr.Close()
+		return isTarStream(gzr)
+	case hasZstdMagic(magic):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return false
+		}
+		defer zr.Close()
+		return isTarStream(zr)
+	}
+	return false
+}
+
+// peekMagic reads up to 4 bytes from r without requiring it to be seekable
+// past them; it's only used on freshly (re)opened/seeked readers.
+func peekMagic(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 4)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func hasGzipMagic(b []byte) bool {
+	return len(b) >= 2 && b[0] == gzipMagic[0] && b[1] == gzipMagic[1]
+}
+
+func hasZstdMagic(b []byte) bool {
+	return len(b) >= 4 && b[0] == zstdMagic[0] && b[1] == zstdMagic[1] && b[2] == zstdMagic[2] && b[3] == zstdMagic[3]
+}
+
+func isTarStream(r io.Reader) bool {
+	tr := tar.NewReader(r)
+	_, err := tr.Next()
+	return err == nil
+}
+
+// UnTar extracts the (optionally gzip-compressed) tar stream r into dir,
+// returning the absolute paths of every entry it wrote.
+func UnTar(r io.Reader, dir string) ([]string, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	var tr *tar.Reader
+	switch {
+	case hasGzipMagic(magic):
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating gzip reader")
+		}
+		defer gzr.Close()
+		tr = tar.NewReader(gzr)
+	case hasZstdMagic(magic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating zstd reader")
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	default:
+		tr = tar.NewReader(br)
+	}
+
+	var extracted []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "reading tar entry")
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := filesystem.FS.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return nil, errors.Wrapf(err, "creating directory %s", target)
+			}
+		case tar.TypeSymlink:
+			if err := filesystem.FS.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return nil, errors.Wrapf(err, "creating parent of %s", target)
+			}
+			if err := filesystem.FS.Symlink(hdr.Linkname, target); err != nil {
+				return nil, errors.Wrapf(err, "creating symlink %s", target)
+			}
+		default:
+			if err := filesystem.FS.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return nil, errors.Wrapf(err, "creating parent of %s", target)
+			}
+			out, err := filesystem.FS.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return nil, errors.Wrapf(err, "creating %s", target)
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return nil, errors.Wrapf(err, "writing %s", target)
+			}
+			out.Close()
+		}
+
+		if err := filesystem.FS.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			logrus.Debugf("untar: setting mtime of %s: %v", target, err)
+		}
+
+		extracted = append(extracted, target)
+	}
+
+	return extracted, nil
+}
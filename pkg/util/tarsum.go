@@ -0,0 +1,147 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/copier"
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// canonicalHeaderFields returns the fixed set of tar header fields this
+// package's TarSum implementation hashes, modeled on Docker's historical
+// pkg/tarsum Version1 algorithm: mtime is normalized to 0 so that
+// NewReproducibleTar's timestamp-zeroing doesn't change the sum, and every
+// other field that affects the file's on-disk identity is included.
+func canonicalHeaderFields(hdr *tar.Header) map[string]string {
+	return map[string]string{
+		"name":     hdr.Name,
+		"mode":     strconv.FormatInt(hdr.Mode, 10),
+		"uid":      strconv.Itoa(hdr.Uid),
+		"gid":      strconv.Itoa(hdr.Gid),
+		"size":     strconv.FormatInt(hdr.Size, 10),
+		"mtime":    "0",
+		"typeflag": string(hdr.Typeflag),
+		"linkname": hdr.Linkname,
+		"uname":    hdr.Uname,
+		"gname":    hdr.Gname,
+		"devmajor": strconv.FormatInt(hdr.Devmajor, 10),
+		"devminor": strconv.FormatInt(hdr.Devminor, 10),
+	}
+}
+
+// canonicalHeaderBytes serializes hdr's canonical fields in sorted-by-name
+// order, so that two headers describing the same entry always produce the
+// same bytes regardless of how archive/tar populated the struct.
+func canonicalHeaderBytes(hdr *tar.Header) []byte {
+	fields := canonicalHeaderFields(hdr)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s=%s\n", name, fields[name])
+	}
+	return buf.Bytes()
+}
+
+// entryDigest computes the per-entry tarsum digest: sha256 of the entry's
+// canonical header followed by its content (empty for non-regular files).
+func entryDigest(hdr *tar.Header, content []byte) []byte {
+	h := sha256.New()
+	h.Write(canonicalHeaderBytes(hdr))
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+// Sum returns the TarSum (Version1) digest of every entry added to t so
+// far, in the form "tarsum.v1+sha256:<hex>". Unlike hashing the raw tar
+// byte stream, this digest only depends on each entry's canonicalized
+// header and content, not on the order entries were added in or on which
+// timestamps a non-reproducible Tar happened to record — so the same
+// filesystem content tarred via two different WalkDir orderings (which
+// varies across filesystems) still yields the same digest, and that digest
+// can be safely folded into a RUN cache key.
+func (t *Tar) Sum() digest.Digest {
+	sorted := make([][]byte, len(t.entryDigests))
+	copy(sorted, t.entryDigests)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+
+	h := sha256.New()
+	for _, d := range sorted {
+		h.Write(d)
+	}
+	return digest.Digest(fmt.Sprintf("tarsum.v1+sha256:%x", h.Sum(nil)))
+}
+
+// CreateTarballOfDirectoryWithSum behaves exactly like
+// CreateTarballOfDirectory, but also returns the resulting tarball's
+// TarSum digest, so callers that need a content-addressable key for the
+// tarball (e.g. to name a cache snapshot) don't have to re-read it back.
+func CreateTarballOfDirectoryWithSum(dir string, w io.Writer) (digest.Digest, error) {
+	gzw := gzip.NewWriter(w)
+	t := NewTar(gzw)
+
+	err := filesystem.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Re-resolve path through copier.SecureJoin, rather than trusting
+		// the path WalkDir handed us, so that a symlink swapped into dir
+		// between WalkDir's stat and here can't smuggle AddFileToTar into
+		// reading content from outside dir.
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errors.Wrapf(err, "relativizing %s", path)
+		}
+		safe, err := copier.SecureJoin(dir, rel)
+		if err != nil {
+			return errors.Wrapf(err, "resolving %s safely", path)
+		}
+		return t.AddFileToTar(safe)
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "tarring directory %s", dir)
+	}
+
+	sum := t.Sum()
+	if err := t.Close(); err != nil {
+		return "", err
+	}
+	if err := gzw.Close(); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
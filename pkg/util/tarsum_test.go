@@ -0,0 +1,70 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/filesystem"
+	"github.com/GoogleContainerTools/kaniko/testutil"
+)
+
+func Test_CreateTarballOfDirectoryWithSum_StableAcrossMtime(t *testing.T) {
+	tmpDir := t.TempDir()
+	createFilesInTempDir(t, tmpDir)
+
+	f := &bytes.Buffer{}
+	sum, err := CreateTarballOfDirectoryWithSum(tmpDir, f)
+	testutil.CheckNoError(t, err)
+	if sum == "" {
+		t.Fatal("expected a non-empty digest")
+	}
+
+	// Tarring the same directory twice should yield the same sum, even
+	// though a file's mtime changed in between, so the two Tars don't
+	// record the same timestamps.
+	mtime := time.Now().Add(-time.Hour)
+	testutil.CheckNoError(t, filesystem.FS.Chtimes(filepath.Join(tmpDir, "0"), mtime, mtime))
+	f2 := &bytes.Buffer{}
+	sum2, err := CreateTarballOfDirectoryWithSum(tmpDir, f2)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, sum, sum2)
+}
+
+func Test_Tar_Sum_OrderIndependent(t *testing.T) {
+	tmpDir := t.TempDir()
+	createFilesInTempDir(t, tmpDir)
+	files := []string{
+		tmpDir + "/0",
+		tmpDir + "/1",
+	}
+
+	forward := NewReproducibleTar(&bytes.Buffer{})
+	for _, path := range files {
+		testutil.CheckNoError(t, forward.AddFileToTar(path))
+	}
+
+	reversed := NewReproducibleTar(&bytes.Buffer{})
+	for i := len(files) - 1; i >= 0; i-- {
+		testutil.CheckNoError(t, reversed.AddFileToTar(files[i]))
+	}
+
+	testutil.CheckDeepEqual(t, forward.Sum(), reversed.Sum())
+}